@@ -1,15 +1,30 @@
 package database
 
 import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"net/url"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/dimaskiddo/go-whatsapp-multidevice-rest/pkg/env"
 	"github.com/dimaskiddo/go-whatsapp-multidevice-rest/pkg/log"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/text/language"
+	"gorm.io/datatypes"
 	"gorm.io/driver/mysql"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 var (
@@ -18,6 +33,87 @@ var (
 	dbOnce     sync.Once
 )
 
+// Tipos de mensagem com contador próprio em User e UserHistory
+var messageTypes = []string{"text", "image", "voice", "video", "sticker", "location", "contact", "document"}
+
+// Eventos aceitos em User.Events; "All" inscreve o usuário em todos
+var webhookEvents = []string{"All", "Message", "ReadReceipt", "Presence", "ChatPresence", "HistorySync", "Connected", "Disconnected"}
+
+// Motivos aceitos em User.DisconnectReason
+var disconnectReasons = []string{"unknown", "logout", "banned", "network", "expired"}
+
+// Formatos de payload aceitos em User.WebhookFormat
+var webhookFormats = []string{"json", "form"}
+
+// Esquemas de proxy aceitos em User.ProxyUrl
+var proxySchemes = []string{"http", "socks5"}
+
+// Escopos de API aceitos em User.Scopes; "admin" concede todos os demais
+var apiScopes = []string{"send", "read", "admin"}
+
+// Cache do dashboard da empresa no Redis configurado por ela
+const (
+	dashboardCacheTTL     = 30 * time.Second
+	dashboardRedisTimeout = 500 * time.Millisecond
+)
+
+// Auditoria do Redis das empresas: timeout por empresa e quantas verificadas em paralelo
+const (
+	redisAuditTimeout     = 2 * time.Second
+	redisAuditConcurrency = 10
+)
+
+// Diferença tolerada entre o total do usuário e a soma do histórico antes de
+// ValidateCounters acusar divergência: o maior entre o mínimo absoluto e a fração
+const (
+	counterToleranceMin      = 10
+	counterToleranceFraction = 0.1
+)
+
+// Tamanho máximo da mensagem automática de ausência
+const autoReplyMaxLength = 1024
+
+// Tamanho mínimo da busca global de usuários, evitando varrer a tabela inteira
+const adminSearchMinLength = 3
+
+// Quantidade máxima de parâmetros por cláusula IN em consultas em lote
+const batchQuerySize = 500
+
+var (
+	ErrInvalidMessageType      = errors.New("invalid message type")
+	ErrInvalidCount            = errors.New("invalid count")
+	ErrInvalidConnectionEvent  = errors.New("invalid connection event")
+	ErrCompanyNotFound         = errors.New("company not found")
+	ErrUserNotFound            = errors.New("user not found")
+	ErrCompanyExpired          = errors.New("company expired")
+	ErrCompanySuspended        = errors.New("company suspended")
+	ErrCompanyOverLimit        = errors.New("company over connections limit")
+	ErrDuplicateToken          = errors.New("duplicate token")
+	ErrInvalidLookback         = errors.New("invalid lookback days")
+	ErrInvalidSpikeFactor      = errors.New("invalid spike factor")
+	ErrInvalidScope            = errors.New("invalid scope")
+	ErrInvalidJid              = errors.New("invalid jid")
+	ErrInvalidPhone            = errors.New("invalid phone number")
+	ErrNoInstanceCapacity      = errors.New("no instance with available capacity")
+	ErrDayNotCompleted         = errors.New("day is not completed yet")
+	ErrInvalidWebhook          = errors.New("invalid webhook url")
+	ErrInvalidEvents           = errors.New("invalid events")
+	ErrInvalidDirection        = errors.New("invalid message direction")
+	ErrInvalidDisconnectReason = errors.New("invalid disconnect reason")
+	ErrSearchQueryTooShort     = errors.New("search query too short")
+	ErrInvalidBudget           = errors.New("invalid budget")
+	ErrInvalidWebhookFormat    = errors.New("invalid webhook format")
+	ErrInvalidProxy            = errors.New("invalid proxy url")
+	ErrInvalidResetHour        = errors.New("invalid reset hour")
+	ErrInvalidAutoReply        = errors.New("invalid auto reply text")
+	ErrTemplateNotFound        = errors.New("template not found")
+	ErrDuplicateTemplate       = errors.New("duplicate template name")
+	ErrInvalidTemplate         = errors.New("invalid template")
+	ErrInstanceMismatch        = errors.New("user belongs to another instance")
+	ErrNilMutate               = errors.New("mutate function is required")
+	ErrInvalidLocale           = errors.New("invalid locale")
+)
+
 type Service interface {
 	CreateUser(user *User) (int, error)
 	UpdateUser(user *User) error
@@ -25,7 +121,8 @@ type Service interface {
 	SetQrcode(id int, qrcode string, instance string) error
 	SetWebhook(id int, webhook string) error
 	SetConnected(id int) error
-	SetDisconnected(id int) error
+	// SetDisconnected marca o usuário como desconectado registrando o motivo (vazio vira "unknown")
+	SetDisconnected(id int, reason string) error
 	SetJid(id int, jid string) error
 	SetEvents(id int, events string) error
 	GetUserById(id int) (*User, error)
@@ -41,6 +138,269 @@ type Service interface {
 	GetCompanyByToken(token string) (*Company, error)
 	CountConnectedUsers(instance string) (int, error)
 	ListAllUsersCompany(companyId int, instance string) ([]*User, error)
+	// ListUsersChangedSince retorna os usuários da instância alterados após `since`
+	ListUsersChangedSince(instance string, since time.Time) ([]*User, error)
+	// DecrementMessageCount desfaz `n` incrementos do contador, sem deixá-lo negativo
+	DecrementMessageCount(userID uint, typeMsg string, n int) error
+	// ListUsersByTodayEvent retorna os usuários que conectaram ou desconectaram hoje
+	ListUsersByTodayEvent(instance string, eventType string) ([]*User, error)
+	// AuthorizeCompany valida o token da empresa, a data limite e o limite de conexões
+	AuthorizeCompany(token string) (*Company, error)
+	// IncrementTypedCount soma `n` ao contador diário de qualquer tipo de mensagem
+	IncrementTypedCount(userID uint, date time.Time, msgType string, n int) error
+	// GetTypedCountsAsHistory reconstrói os campos fixos de UserHistory a partir de MessageCounter
+	GetTypedCountsAsHistory(userID uint, date time.Time) (*UserHistory, error)
+	// RecentUserHistory retorna as `n` linhas de histórico mais recentes do usuário
+	RecentUserHistory(userID uint, n int) ([]*UserHistory, error)
+	// CreateCompany cria a empresa, retornando ErrDuplicateToken se o token já existir
+	CreateCompany(company *Company) (int, error)
+	// ListUsersByRecentActivity lista os usuários da empresa pela atividade mais recente no histórico
+	ListUsersByRecentActivity(companyId int, instance string, limit int) ([]*User, error)
+	// CompanyUptimePercent retorna a média do percentual do dia em que os usuários da empresa ficaram online
+	CompanyUptimePercent(companyId int, day time.Time) (float64, error)
+	// RunMigrations aplica, em ordem, as migrações ainda não registradas em SchemaMigration
+	RunMigrations(migrations []Migration) error
+	// GetUsersByTokens busca vários usuários de uma vez, indexados pelo token
+	GetUsersByTokens(tokens []string) (map[string]*User, error)
+	// DetectCounterSpikes retorna os usuários cujo total de hoje excede a média recente multiplicada por `factor`
+	DetectCounterSpikes(instance string, lookbackDays int, factor float64) ([]SpikeAlert, error)
+	// SetScopes define os escopos de API do usuário (separados por vírgula)
+	SetScopes(id int, scopes string) error
+	// SetConnectedWithJid marca o usuário como conectado e grava o jid em uma única atualização
+	SetConnectedWithJid(id int, jid string, instance string) error
+	// ListCompaniesWithUsage lista as empresas paginadas com a quantidade de usuários conectados
+	ListCompaniesWithUsage(limit, offset int) ([]CompanyUsage, int64, error)
+	// ResetWebhookBackoff zera as falhas de webhook e libera a entrega imediatamente
+	ResetWebhookBackoff(id int) error
+	// DeduplicateActiveSessions mantém conectado apenas o usuário mais recente de cada jid duplicado
+	DeduplicateActiveSessions() ([]int, error)
+	// InstanceTypeTotals soma cada tipo de mensagem do dia para os usuários da instância
+	InstanceTypeTotals(instance string, day time.Time) (map[string]int64, error)
+	// ListUsersForRetentionDeletion lista usuários desconectados e inativos há mais de `inactiveFor`
+	// cujas empresas permitem a exclusão por retenção
+	ListUsersForRetentionDeletion(inactiveFor time.Duration) ([]*User, error)
+	// TryAcquireConnection reserva uma conexão da empresa se ainda houver vaga no limite
+	TryAcquireConnection(companyId int) (bool, error)
+	// ReleaseConnection devolve uma conexão reservada por TryAcquireConnection
+	ReleaseConnection(companyId int) error
+	// GetCompanyByUserToken retorna a empresa do usuário dono do token
+	GetCompanyByUserToken(userToken string) (*Company, error)
+	// SetUserMetadata mescla `meta` nos metadados do usuário; valores vazios removem a chave
+	SetUserMetadata(id int, meta map[string]string) error
+	// GetUserMetadata retorna os metadados do usuário
+	GetUserMetadata(id int) (map[string]string, error)
+	// FindUsersByMetadata busca os usuários da empresa cujo metadado `key` é igual a `value`
+	FindUsersByMetadata(companyId int, key, value string) ([]*User, error)
+	// BulkInsertHistory insere linhas de histórico em lotes, atualizando as que já existirem para o mesmo dia
+	BulkInsertHistory(rows []UserHistory) error
+	// RecordConnectAttempt registra uma tentativa de (re)conexão do usuário
+	RecordConnectAttempt(id int) error
+	// ConnectionHealth calcula a saúde da conexão (0-100) e sua categoria
+	ConnectionHealth(userID uint) (*HealthScore, error)
+	// ListStalePairings lista usuários desconectados com pairing code gerado há mais de `olderThan`
+	ListStalePairings(instance string, olderThan time.Duration) ([]*User, error)
+	// CountUsersByWebhookHost conta quantos usuários enviam webhooks para cada host
+	CountUsersByWebhookHost() (map[string]int, error)
+	// CreateUserOnBestInstance cria o usuário na instância candidata menos ocupada da empresa,
+	// respeitando ConnectionsInstance
+	CreateUserOnBestInstance(user *User, candidateInstances []string) (int, string, error)
+	// CompletedDayCounts retorna os contadores de um dia já encerrado
+	CompletedDayCounts(userID uint, day time.Time) (map[string]int, error)
+	// SetCompanySuspended suspende ou reativa a empresa, independente da data limite
+	SetCompanySuspended(id int, suspended bool) error
+	// CompanyInstanceBreakdown conta os usuários conectados da empresa em cada instância
+	CompanyInstanceBreakdown(companyId int) (map[string]int, error)
+	// MergeCounters soma os contadores (totais e histórico) de `fromId` em `keepId` e zera os de `fromId`
+	MergeCounters(keepId uint, fromId uint) error
+	// ListConnectedUsersWithVersion retorna os usuários conectados e um etag que muda quando algum deles é alterado
+	ListConnectedUsersWithVersion(instance string) ([]*User, string, error)
+	// ConnectedUsersEtag calcula apenas o etag dos usuários conectados, sem carregar as linhas completas
+	ConnectedUsersEtag(instance string) (string, error)
+	// FindOrphanedHistory retorna os ids de histórico cujo usuário não existe mais (nem excluído logicamente)
+	FindOrphanedHistory() ([]uint, error)
+	// CleanOrphanedHistory remove definitivamente o histórico órfão
+	CleanOrphanedHistory() (int64, error)
+	// CountRecentReconnectFailures conta usuários desconectados com tentativas de reconexão recentes
+	CountRecentReconnectFailures(instance string, within time.Duration) (int64, error)
+	// SetDeviceInfo grava a plataforma e o modelo do aparelho pareado
+	SetDeviceInfo(id int, platform, deviceModel string) error
+	// ListCompanyUsersByEvent lista os usuários conectados da empresa inscritos no evento
+	ListCompanyUsersByEvent(companyId int, event string) ([]*User, error)
+	// CompanyDashboard resume usuários, conexões e mensagens do dia da empresa,
+	// usando o Redis da empresa como cache quando RedisUri estiver configurado
+	CompanyDashboard(companyId int) (*DashboardSummary, error)
+	// TableStats retorna a quantidade de linhas e o tamanho em bytes das tabelas principais
+	TableStats() (map[string]TableSize, error)
+	// SetLastError registra o último erro da sessão do usuário
+	SetLastError(id int, reason string) error
+	// ListUsersWithErrors lista os usuários da instância com erro registrado
+	ListUsersWithErrors(instance string) ([]*User, error)
+	// CompanyMonthlyGrowth compara o total de mensagens do mês com o mês anterior
+	CompanyMonthlyGrowth(companyId int, month time.Time) (*GrowthResult, error)
+	// GlobalAtCapacity indica se o total de usuários conectados na plataforma atingiu `maxTotal`.
+	// Com maxTotal <= 0 é usado GLOBAL_CONNECTION_LIMIT; sem limite configurado nunca está no limite
+	GlobalAtCapacity(maxTotal int) (bool, error)
+	// ListUsersToRestoreByPriority lista os usuários a restaurar na instância, empresas prioritárias primeiro
+	ListUsersToRestoreByPriority(instance string) ([]*User, error)
+	// CompanyDailyBreakdown retorna os contadores do dia de cada usuário da empresa, zerados para quem não teve atividade
+	CompanyDailyBreakdown(companyId int, day time.Time) ([]UserDayCount, error)
+	// ConfigureUser valida e grava webhook e eventos juntos, sem alterar nada se algum for inválido
+	ConfigureUser(id int, webhook, events string) error
+	// IsJidConnected indica se há um usuário conectado com o jid na instância
+	IsJidConnected(jid string, instance string) (bool, error)
+	// SnapshotCompanySeats grava a ocupação de assentos de todas as empresas no dia
+	SnapshotCompanySeats(day time.Time) error
+	// GetCompanySeatHistory retorna os snapshots de assentos da empresa no intervalo
+	GetCompanySeatHistory(companyId int, from, to time.Time) ([]CompanySeatSnapshot, error)
+	// GetUserByPhone busca o usuário da instância pelo telefone (apenas dígitos)
+	GetUserByPhone(phone string, instance string) (*User, error)
+	// RecalculateUserTotals recalcula os totais do usuário a partir da soma do histórico
+	RecalculateUserTotals(id int) error
+	// FirstConnectedAt retorna a primeira conexão registrada no histórico do usuário (nil se nunca conectou)
+	FirstConnectedAt(userID uint) (*time.Time, error)
+	// DisconnectCompanyUsers desconecta todos os usuários conectados da empresa e retorna seus ids
+	DisconnectCompanyUsers(companyId int) ([]int, error)
+	// TokenExists indica se existe um usuário com o token, sem carregar a linha
+	TokenExists(token string) (bool, error)
+	// HourlyBreakdown retorna as 24 horas do dia com as contagens por tipo (zeradas quando sem atividade)
+	HourlyBreakdown(userID uint, day time.Time) ([]HourCount, error)
+	// SetInstance move o usuário para outra instância, registrando quando a troca ocorreu
+	SetInstance(id int, instance string) error
+	// ListUsersRecentlyRebalanced lista os usuários que trocaram de instância dentro da janela
+	ListUsersRecentlyRebalanced(within time.Duration) ([]*User, error)
+	// RecordWebhookDelivery registra o resultado de uma entrega de webhook
+	RecordWebhookDelivery(userID uint, statusCode int, deliveryErr string) error
+	// CompanyWebhookErrorRate retorna a fração de entregas com erro ou status fora de 2xx no intervalo
+	CompanyWebhookErrorRate(companyId int, from, to time.Time) (float64, error)
+	// GetRandomConnectedUser retorna um usuário conectado qualquer da instância (usado em smoke tests)
+	GetRandomConnectedUser(instance string) (*User, error)
+	// RecordConnectionEvent registra uma conexão ou desconexão da sessão do usuário
+	RecordConnectionEvent(userID uint, instance string, eventType string) error
+	// AverageReconnectsPerDay retorna a média diária de conexões do usuário no intervalo
+	AverageReconnectsPerDay(userID uint, from, to time.Time) (float64, error)
+	// AddAllowedRecipient adiciona o jid à lista de destinatários permitidos do usuário
+	AddAllowedRecipient(userID uint, jid string) error
+	// RemoveAllowedRecipient remove o jid da lista de destinatários permitidos do usuário
+	RemoveAllowedRecipient(userID uint, jid string) error
+	// ListAllowedRecipients lista os destinatários permitidos do usuário
+	ListAllowedRecipients(userID uint) ([]string, error)
+	// IsRecipientAllowed indica se o usuário pode enviar para o jid (lista vazia permite todos)
+	IsRecipientAllowed(userID uint, jid string) (bool, error)
+	// LogRecipient registra (ou atualiza) o último envio do usuário para o jid
+	LogRecipient(userID uint, jid string) error
+	// CountUniqueRecipients conta os destinatários distintos cujo último envio está no intervalo.
+	// Só o último envio é guardado: quem recebeu no intervalo e de novo depois de `to` não é
+	// contado, então janelas que não terminam agora ficam subestimadas
+	CountUniqueRecipients(userID uint, from, to time.Time) (int64, error)
+	// PurgeRecipientLog remove registros de destinatários sem envio há mais de `olderThan`
+	PurgeRecipientLog(olderThan time.Duration) (int64, error)
+	// TryStartSend reserva um envio concorrente do usuário se estiver abaixo de `max`
+	TryStartSend(id int, max int) (bool, error)
+	// FinishSend libera um envio reservado por TryStartSend
+	FinishSend(id int) error
+	// ExportUserData reúne o usuário, o nome da empresa e todas as tabelas derivadas dele
+	ExportUserData(id int) (*UserDataExport, error)
+	// EraseUserData remove definitivamente o usuário e todos os dados derivados dele
+	EraseUserData(id int) error
+	// IncrementDirectionalCount soma `n` ao contador do dia para mensagens recebidas ("in") ou enviadas ("out")
+	IncrementDirectionalCount(userID uint, typeMsg string, direction string, n int) error
+	// DirectionalTotals retorna o total de mensagens recebidas e enviadas no intervalo, indexado por "in"/"out"
+	DirectionalTotals(userID uint, from, to time.Time) (map[string]int64, error)
+	// TopCompaniesByUsage lista as empresas com mais mensagens no mês, em ordem decrescente
+	TopCompaniesByUsage(month time.Time, limit int) ([]CompanyUsage, error)
+	// ValidateCounters aponta usuários com totais negativos ou divergentes da soma do histórico
+	ValidateCounters(instance string) ([]CounterAnomaly, error)
+	// TryAcquireQrLock obtém a trava de geração de QR do usuário por `ttl`, se estiver livre ou expirada
+	TryAcquireQrLock(id int, instance string, ttl time.Duration) (bool, error)
+	// ReleaseQrLock libera a trava de geração de QR do usuário
+	ReleaseQrLock(id int, instance string) error
+	// ListCompanyUsersWithWebhook lista os usuários da empresa com webhook configurado
+	ListCompanyUsersWithWebhook(companyId int) ([]*User, error)
+	// MedianDailyMessages calcula a mediana do total diário de mensagens no intervalo, contando dias sem atividade como zero
+	MedianDailyMessages(userID uint, from, to time.Time) (float64, error)
+	// SetLabel define o apelido da conexão exibido na listagem da empresa
+	SetLabel(id int, label string) error
+	// ListRecentStatusChanges lista as conexões/desconexões de todas as instâncias dentro da janela, mais recentes primeiro
+	ListRecentStatusChanges(within time.Duration) ([]StatusChange, error)
+	// SetCompanyAllowedMsgTypes restringe os tipos de mensagem da empresa (separados por vírgula, vazio libera todos)
+	SetCompanyAllowedMsgTypes(id int, msgTypes string) error
+	// CompanyAllowsType indica se o plano da empresa permite o tipo de mensagem
+	CompanyAllowsType(companyId int, msgType string) (bool, error)
+	// CompanyOnlinePercent retorna o percentual de usuários da empresa conectados agora
+	CompanyOnlinePercent(companyId int) (float64, error)
+	// ListUsersByDisconnectReason lista os usuários desconectados da instância pelo motivo
+	ListUsersByDisconnectReason(instance, reason string) ([]*User, error)
+	// AdminSearchUsers busca usuários de todas as empresas pelo início do token ou parte do nome
+	AdminSearchUsers(query string, limit, offset int) ([]*User, int64, error)
+	// ConsumeBudget debita n mensagens do orçamento diário do usuário, se houver saldo
+	ConsumeBudget(id int, n int) (remaining int, ok bool, err error)
+	// SetDailyBudget define o orçamento diário do usuário (0 = ilimitado) e renova o saldo
+	SetDailyBudget(id int, budget int) error
+	// ResetBudgets renova o saldo diário dos usuários da instância
+	ResetBudgets(instance string) error
+	// ListCompaniesOverInstanceCap lista pares empresa/instância com mais conectados que o permitido
+	ListCompaniesOverInstanceCap() ([]CapViolation, error)
+	// ListUsersMissingEvent lista conectados da instância que ainda não recebem o evento
+	ListUsersMissingEvent(instance string, event string) ([]*User, error)
+	// RankUsersByStability ordena os usuários da empresa do menos para o mais estável no período
+	RankUsersByStability(companyId int, from, to time.Time) ([]UserStability, error)
+	// SetWebhookFormat define o formato do payload enviado ao webhook (json ou form)
+	SetWebhookFormat(id int, format string) error
+	// PlatformStats resume empresas, usuários, conectados e mensagens de hoje de toda a plataforma
+	PlatformStats() (*PlatformSummary, error)
+	// SetProxy define o proxy usado pela sessão do usuário; vazio remove o proxy
+	SetProxy(id int, proxyUrl string) error
+	// GetProxy retorna o proxy configurado para o usuário, ou vazio se não houver
+	GetProxy(id int) (string, error)
+	// ListUsersWithProxy lista os conectados da instância que usam proxy, para checagem periódica
+	ListUsersWithProxy(instance string) ([]*User, error)
+	// SetCompanyResetHour define a hora (UTC, 0-23) em que o dia da empresa vira
+	SetCompanyResetHour(id int, hour int) error
+	// ResetDueCompanies retorna as empresas cujo horário de virada do dia (UTC) é a hora atual.
+	// Limitação: ainda não há virada por empresa. As contagens (UserHistory.Date) seguem o dia
+	// do servidor e o saldo diário é renovado só por ResetBudgets.
+	ResetDueCompanies(now time.Time) ([]int, error)
+	// RecordWebhookSuccess registra a última entrega bem-sucedida do webhook. Como o webhook
+	// voltou a responder, também zera as falhas e encerra o backoff (WebhookDisabledUntil).
+	RecordWebhookSuccess(id int) error
+	// ListCompanyUsersByVolume lista os usuários da empresa com mais mensagens no dia primeiro
+	ListCompanyUsersByVolume(companyId int, day time.Time, limit int) ([]*User, error)
+	// ProjectLimitExhaustion estima em quantos dias a empresa atinge o limite de conexões
+	ProjectLimitExhaustion(companyId int, lookbackDays int) (*Projection, error)
+	// ListNeverConnectedUsers lista os usuários da empresa que nunca parearam desde o cadastro
+	ListNeverConnectedUsers(companyId int) ([]*User, error)
+	// SetEventsForUsers aplica a mesma inscrição de eventos a vários usuários de uma vez
+	SetEventsForUsers(ids []int, events string) (int, error)
+	// InstanceHasConnectedUsers informa se ainda há sessões conectadas na instância
+	InstanceHasConnectedUsers(instance string) (bool, error)
+	// SetAutoReply configura a resposta automática de ausência do usuário
+	SetAutoReply(id int, enabled bool, text string) error
+	// CountPendingQr conta os usuários da instância aguardando leitura do QR code
+	CountPendingQr(instance string) (int64, error)
+	// InstanceDashboard reúne conectados, pendentes de QR e totais do dia da instância
+	InstanceDashboard(instance string) (*InstanceDashboardResult, error)
+	// ListCompaniesCreatedSince lista as empresas cadastradas a partir da data, mais recentes primeiro
+	ListCompaniesCreatedSince(since time.Time) ([]*Company, error)
+	// CreateTemplate cria um modelo de mensagem do usuário; o nome é único por usuário
+	CreateTemplate(userID uint, name, body string) (*MessageTemplate, error)
+	// ListTemplates lista os modelos de mensagem do usuário por nome
+	ListTemplates(userID uint) ([]MessageTemplate, error)
+	// GetTemplate busca um modelo de mensagem do usuário pelo nome
+	GetTemplate(userID uint, name string) (*MessageTemplate, error)
+	// DeleteTemplate remove um modelo de mensagem do usuário pelo nome
+	DeleteTemplate(userID uint, name string) error
+	// MediaTextRatio calcula a proporção de mensagens de mídia por mensagem de texto no período
+	MediaTextRatio(userID uint, from, to time.Time) (float64, error)
+	// ClaimAndUpdate trava o usuário da instância, aplica mutate e salva, tudo na mesma transação
+	ClaimAndUpdate(id int, instance string, mutate func(*User)) (*User, error)
+	// BackfillConnectionTimes estima connected_at de históricos online anteriores ao recurso
+	BackfillConnectionTimes(from, to time.Time) (int64, error)
+	// ListCompaniesWithBrokenRedis lista as empresas com Redis configurado que não responde ao PING
+	ListCompaniesWithBrokenRedis() ([]CompanyRedisStatus, error)
+	// SetLocale define o idioma do usuário (tag BCP 47) usado nas mensagens automáticas
+	SetLocale(id int, locale string) error
+	// GetLocale retorna o idioma configurado para o usuário
+	GetLocale(id int) (string, error)
 }
 
 type User struct {
@@ -67,14 +427,117 @@ type User struct {
 	CompanyId        int     `gorm:"default:null"`
 	Company          Company `gorm:"foreignKey:CompanyId;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"` // Relacionamento correto
 	WhatsappId       int     `gorm:"type:integer;default:null"`
+	Scopes           string  `gorm:"type:text;not null;default:'send,read'"`
+	// Backoff de entrega do webhook após falhas consecutivas
+	WebhookFailCount     int        `gorm:"type:integer;not null;default:0"`
+	WebhookDisabledUntil *time.Time `gorm:"type:timestamp;default:null"`
+	// Pares chave/valor livres do integrador (jsonb no Postgres, json no MySQL)
+	Metadata           datatypes.JSONMap `gorm:"default:null"`
+	ConnectAttempts    int               `gorm:"type:integer;not null;default:0"`
+	LastConnectAttempt *time.Time        `gorm:"type:timestamp;default:null"`
+	PairingGeneratedAt *time.Time        `gorm:"type:timestamp;default:null"`
+	Platform           string            `gorm:"type:text;not null;default:''"`
+	DeviceModel        string            `gorm:"type:text;not null;default:''"`
+	LastError          string            `gorm:"type:text;not null;default:''"`
+	LastErrorAt        *time.Time        `gorm:"type:timestamp;default:null"`
+	Phone              string            `gorm:"type:varchar(20);not null;default:'';index"`
+	InstanceChangedAt  *time.Time        `gorm:"type:timestamp;default:null"`
+	InUseSends         int               `gorm:"type:integer;not null;default:0"`
+	QrLockUntil        *time.Time        `gorm:"type:timestamp;default:null"`
+	Label              string            `gorm:"type:text;not null;default:''"`
+	DisconnectReason   string            `gorm:"type:varchar(16);not null;default:'unknown'"`
+	// Orçamento diário de mensagens (0 = ilimitado) e saldo restante do dia
+	DailyBudget     int    `gorm:"type:integer;not null;default:0"`
+	BudgetRemaining int    `gorm:"type:integer;not null;default:0"`
+	WebhookFormat   string `gorm:"type:varchar(8);not null;default:'json'"`
+	ProxyUrl        string `gorm:"type:text;not null;default:''"`
+	// Última entrega bem-sucedida do webhook; nulo se nunca houve sucesso
+	LastWebhookSuccessAt *time.Time `gorm:"type:timestamp;default:null"`
+	AutoReplyEnabled     bool       `gorm:"type:boolean;not null;default:false"`
+	AutoReplyText        string     `gorm:"type:text;not null;default:''"`
+	Locale               string     `gorm:"type:varchar(35);not null;default:'en'"`
+}
+
+// UserResponse é a representação do usuário exposta pela API, sem campos internos
+// do gorm nem dados sensíveis (token, qrcode, pairing code)
+type UserResponse struct {
+	ID                   uint       `json:"id"`
+	Name                 string     `json:"name"`
+	Label                string     `json:"label"`
+	Jid                  string     `json:"jid"`
+	Webhook              string     `json:"webhook"`
+	Events               string     `json:"events"`
+	Instance             string     `json:"instance"`
+	Status               string     `json:"status"`
+	CompanyId            int        `json:"company_id"`
+	TotalMessages        int        `json:"total_messages"`
+	CreatedAt            time.Time  `json:"created_at"`
+	LastWebhookSuccessAt *time.Time `json:"last_webhook_success_at"`
+}
+
+// ToResponse converte o usuário para o DTO retornado pela API
+func (u *User) ToResponse() UserResponse {
+	status := "disconnected"
+	if u.Connected == 1 {
+		status = "connected"
+	}
+
+	return UserResponse{
+		ID:        u.ID,
+		Name:      u.Name,
+		Label:     u.Label,
+		Jid:       u.Jid,
+		Webhook:   u.Webhook,
+		Events:    u.Events,
+		Instance:  u.Instance,
+		Status:    status,
+		CompanyId: u.CompanyId,
+		TotalMessages: u.CountTextMsg + u.CountImageMsg + u.CountVoiceMsg + u.CountVideoMsg +
+			u.CountStickerMsg + u.CountLocationMsg + u.CountContactMsg + u.CountDocumentMsg,
+		CreatedAt:            u.CreatedAt,
+		LastWebhookSuccessAt: u.LastWebhookSuccessAt,
+	}
+}
+
+// Counts retorna os contadores do histórico indexados pelo tipo de mensagem
+func (h *UserHistory) Counts() map[string]int {
+	return map[string]int{
+		"text":     h.CountTextMsg,
+		"image":    h.CountImageMsg,
+		"voice":    h.CountVoiceMsg,
+		"video":    h.CountVideoMsg,
+		"sticker":  h.CountStickerMsg,
+		"location": h.CountLocationMsg,
+		"contact":  h.CountContactMsg,
+		"document": h.CountDocumentMsg,
+	}
+}
+
+// Counts retorna os totais acumulados do usuário indexados pelo tipo de mensagem
+func (u *User) Counts() map[string]int {
+	return map[string]int{
+		"text":     u.CountTextMsg,
+		"image":    u.CountImageMsg,
+		"voice":    u.CountVoiceMsg,
+		"video":    u.CountVideoMsg,
+		"sticker":  u.CountStickerMsg,
+		"location": u.CountLocationMsg,
+		"contact":  u.CountContactMsg,
+		"document": u.CountDocumentMsg,
+	}
+}
+
+// WebhookSuppressed indica se a entrega do webhook está suspensa pelo backoff
+func (u *User) WebhookSuppressed() bool {
+	return u.WebhookDisabledUntil != nil && u.WebhookDisabledUntil.After(time.Now())
 }
 
 type UserHistory struct {
 	gorm.Model
 	ID               uint       `gorm:"primaryKey"`
-	UserID           uint       `gorm:"not null;index"`
+	UserID           uint       `gorm:"not null;index;uniqueIndex:idx_user_histories_user_date"`
 	User             *User      `gorm:"foreignKey:UserID"`
-	Date             time.Time  `gorm:"type:timestamp;index"`
+	Date             time.Time  `gorm:"type:timestamp;index;uniqueIndex:idx_user_histories_user_date"`
 	CountTextMsg     int        `gorm:"type:integer;default:0"`
 	CountImageMsg    int        `gorm:"type:integer;default:0"`
 	CountVoiceMsg    int        `gorm:"type:integer;default:0"`
@@ -92,383 +555,4587 @@ type Company struct {
 	gorm.Model
 	ID                  int        `gorm:"primaryKey"`
 	Name                string     `gorm:"type:text;not null;index"`
-	Token               string     `gorm:"type:text;not null;index"`
+	Token               string     `gorm:"type:varchar(255);not null;uniqueIndex"`
 	ConnectionsLimit    int        `gorm:"type:integer;default:10"`
 	ConnectionsInstance int        `gorm:"type:integer;default:200"`
 	DateLimit           *time.Time `gorm:"type:timestamp;default:null"`
 	RedisUri            string     `gorm:"type:text;not null;default:''"`
+	RetentionDeletion   bool       `gorm:"type:boolean;not null;default:false"`
+	ConnectionsInUse    int        `gorm:"type:integer;not null;default:0"`
+	Suspended           bool       `gorm:"type:boolean;not null;default:false"`
+	Priority            int        `gorm:"type:integer;not null;default:0"`
+	AllowedMsgTypes     string     `gorm:"type:text;not null;default:''"`
+	// Hora (UTC, 0-23) em que o dia da empresa vira, permitindo meia-noite local
+	ResetHourUTC int `gorm:"column:reset_hour_utc;type:integer;not null;default:0"`
 }
 
-type service struct {
-	db *gorm.DB
+// MessageCounter guarda a contagem diária por tipo de mensagem, sem exigir
+// uma coluna nova para cada tipo suportado
+type MessageCounter struct {
+	ID        uint      `gorm:"primaryKey"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_message_counters_user_date_type_direction"`
+	Date      time.Time `gorm:"type:timestamp;not null;uniqueIndex:idx_message_counters_user_date_type_direction"`
+	MsgType   string    `gorm:"type:varchar(32);not null;uniqueIndex:idx_message_counters_user_date_type_direction"`
+	Direction string    `gorm:"type:varchar(3);not null;default:'out';uniqueIndex:idx_message_counters_user_date_type_direction"`
+	Count     int       `gorm:"type:integer;not null;default:0"`
+	UpdatedAt time.Time
 }
 
-func startMysql() (*gorm.DB, error) {
-	// log.Print(nil).Info("Starting mysql")
-
-	dbHost := os.Getenv("DB_HOST")
-	dbPort := os.Getenv("DB_PORT")
-	dbUser := os.Getenv("DB_USER")
-	dbPass := os.Getenv("DB_PASSWORD")
-	dbName := os.Getenv("DB_NAME")
-
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=True&loc=Local", dbUser, dbPass, dbHost, dbPort, dbName)
-	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+// CompanySeatSnapshot guarda, por dia, quantos usuários da empresa estavam conectados e cadastrados
+type CompanySeatSnapshot struct {
+	ID             uint      `gorm:"primaryKey"`
+	CompanyID      int       `gorm:"not null;uniqueIndex:idx_company_seat_snapshots_company_date"`
+	Date           time.Time `gorm:"type:timestamp;not null;uniqueIndex:idx_company_seat_snapshots_company_date"`
+	ConnectedCount int       `gorm:"type:integer;not null;default:0"`
+	TotalCount     int       `gorm:"type:integer;not null;default:0"`
+	CreatedAt      time.Time
+}
 
-	if err != nil {
-		log.Print(nil).Error("Could not open/create " + dsn)
-		return nil, err
-	}
+// HourlyCounter guarda a contagem por hora e tipo de mensagem, habilitada por WHATSAPP_HOURLY_COUNTERS
+type HourlyCounter struct {
+	ID         uint      `gorm:"primaryKey"`
+	UserID     uint      `gorm:"not null;uniqueIndex:idx_hourly_counters_user_hour_type"`
+	HourBucket time.Time `gorm:"type:timestamp;not null;uniqueIndex:idx_hourly_counters_user_hour_type"`
+	MsgType    string    `gorm:"type:varchar(32);not null;uniqueIndex:idx_hourly_counters_user_hour_type"`
+	Count      int       `gorm:"type:integer;not null;default:0"`
+}
 
-	return db, nil
+// WebhookDelivery registra cada tentativa de entrega de webhook e seu resultado
+type WebhookDelivery struct {
+	ID         uint      `gorm:"primaryKey"`
+	UserID     uint      `gorm:"not null;index"`
+	StatusCode int       `gorm:"type:integer;not null;default:0"`
+	Error      string    `gorm:"type:text;not null;default:''"`
+	CreatedAt  time.Time `gorm:"index"`
 }
 
-// startPostgres initializes the database connection if it hasn't been already
-func startPostgres() (*gorm.DB, error) {
-	dbOnce.Do(func() {
-		// log.Print(nil).Info("Starting postgres")
+// ConnectionEvent registra cada conexão/desconexão de sessão ("connected" ou "disconnected")
+type ConnectionEvent struct {
+	ID        uint      `gorm:"primaryKey"`
+	UserID    uint      `gorm:"not null;index"`
+	Instance  string    `gorm:"type:varchar(255);not null;default:''"`
+	EventType string    `gorm:"type:varchar(16);not null"`
+	CreatedAt time.Time `gorm:"index"`
+}
 
-		dbConnStr = os.Getenv("WHATSAPP_DATASTORE_URI")
-		var err error
-		dbInstance, err = gorm.Open(postgres.Open(dbConnStr), &gorm.Config{
-			PrepareStmt: true, // Prepara as declarações
-		})
-		if err != nil {
-			log.Print(nil).Error("Could not open/create " + dbConnStr)
-			return
-		}
-		// Configurando o pool de conexões
-		sqlDB, err := dbInstance.DB()
-		if err != nil {
-			log.Print(nil).Error("Could not get DB from gorm.DB")
-			return
-		}
+// AllowedRecipient restringe os destinatários do usuário; sem nenhuma linha todos são permitidos
+type AllowedRecipient struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"not null;uniqueIndex:idx_allowed_recipients_user_jid"`
+	Jid       string `gorm:"type:varchar(255);not null;uniqueIndex:idx_allowed_recipients_user_jid"`
+	CreatedAt time.Time
+}
 
-		// Definindo configurações de pool de conexão
-		sqlDB.SetMaxIdleConns(15)  // Número máximo de conexões inativas
-		sqlDB.SetMaxOpenConns(300) // Número máximo de conexões abertas
-		sqlDB.SetConnMaxLifetime(time.Duration(30000) * time.Millisecond)
-		sqlDB.SetConnMaxIdleTime(time.Duration(600000) * time.Millisecond)
+// RecipientLog guarda o último envio do usuário para cada destinatário (não o histórico de envios)
+type RecipientLog struct {
+	ID     uint      `gorm:"primaryKey"`
+	UserID uint      `gorm:"not null;uniqueIndex:idx_recipient_logs_user_jid"`
+	Jid    string    `gorm:"type:varchar(255);not null;uniqueIndex:idx_recipient_logs_user_jid"`
+	LastAt time.Time `gorm:"type:timestamp;not null;index"`
+}
 
-		log.Print(nil).Info("Connected to database")
-	})
+// MessageTemplate é um modelo de mensagem reutilizável, identificado pelo nome dentro do usuário
+type MessageTemplate struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"not null;uniqueIndex:idx_message_templates_user_name"`
+	Name      string `gorm:"type:varchar(255);not null;uniqueIndex:idx_message_templates_user_name"`
+	Body      string `gorm:"type:text;not null"`
+	CreatedAt time.Time
+}
 
-	if dbInstance == nil {
-		return nil, fmt.Errorf("could not establish database connection")
-	}
+// SchemaMigration registra as migrações de dados já aplicadas
+type SchemaMigration struct {
+	ID        uint `gorm:"primaryKey;autoIncrement:false"`
+	AppliedAt time.Time
+}
 
-	return dbInstance, nil
+// Migration é uma migração numerada, aplicada uma única vez por RunMigrations.
+// BeforeAutoMigrate marca as que corrigem dados que impediriam o AutoMigrate de criar
+// índices únicos novos; numa instalação nova as tabelas delas ainda não existem.
+type Migration struct {
+	ID                uint
+	BeforeAutoMigrate bool
+	Up                func(tx *gorm.DB) error
 }
 
-func NewService(driver string) (Service, error) {
-	var err error
-	var db *gorm.DB
+// migrations lista as migrações executadas em NewService, em ordem de ID dentro de cada
+// fase (antes e depois do AutoMigrate). Novas migrações entram no final com um ID maior.
+var migrations = []Migration{
+	{ID: 1, Up: migrateMessageCounters},
+	{ID: 2, Up: guardDuplicateCompanyTokens, BeforeAutoMigrate: true},
+	{ID: 3, Up: syncConnectionsInUse},
+	{ID: 4, Up: dedupeUserHistories, BeforeAutoMigrate: true},
+	{ID: 5, Up: backfillJidAndPhone},
+	{ID: 6, Up: dropLegacyMessageCounterIndex},
+}
 
-	switch driver {
-	case "mysql":
-		db, err = startMysql()
-	case "postgres":
-		db, err = startPostgres()
-	default:
-		return nil, fmt.Errorf("driver not supported")
+// migrationsPhase filtra as migrações da fase, antes ou depois do AutoMigrate
+func migrationsPhase(beforeAutoMigrate bool) []Migration {
+	phase := make([]Migration, 0, len(migrations))
+	for _, migration := range migrations {
+		if migration.BeforeAutoMigrate == beforeAutoMigrate {
+			phase = append(phase, migration)
+		}
 	}
 
-	log.Print(nil).Info("Migrating database")
-	db.AutoMigrate(&Company{}, &User{}, &UserHistory{})
+	return phase
+}
 
-	if err != nil {
-		return nil, err
-	}
+type CompanyUsage struct {
+	Company        Company
+	ConnectedCount int64
+	MessageTotal   int64
+}
 
-	s := &service{db: db}
+type HourCount struct {
+	Hour   int
+	Total  int
+	ByType map[string]int
+}
 
-	return s, nil
+type UserDayCount struct {
+	UserID           uint
+	Name             string
+	CountTextMsg     int
+	CountImageMsg    int
+	CountVoiceMsg    int
+	CountVideoMsg    int
+	CountStickerMsg  int
+	CountLocationMsg int
+	CountContactMsg  int
+	CountDocumentMsg int
 }
 
-func (s *service) CreateUser(user *User) (int, error) {
+type GrowthResult struct {
+	CurrentTotal  int64
+	PreviousTotal int64
+	PercentChange float64
+	// IsNew indica que não houve mensagens no mês anterior, sem percentual definido
+	IsNew bool
+}
 
-	result := s.db.Create(user)
+// UserExport é o usuário como aparece no export de dados, sem segredos de acesso
+// (token, qrcode, pairing code, proxy com credenciais) nem a empresa embutida
+type UserExport struct {
+	ID               uint              `json:"id"`
+	Name             string            `json:"name"`
+	Label            string            `json:"label"`
+	Jid              string            `json:"jid"`
+	Phone            string            `json:"phone"`
+	Webhook          string            `json:"webhook"`
+	Events           string            `json:"events"`
+	Instance         string            `json:"instance"`
+	Connected        bool              `json:"connected"`
+	CompanyId        int               `json:"company_id"`
+	Platform         string            `json:"platform"`
+	DeviceModel      string            `json:"device_model"`
+	Locale           string            `json:"locale"`
+	AutoReplyEnabled bool              `json:"auto_reply_enabled"`
+	AutoReplyText    string            `json:"auto_reply_text"`
+	Metadata         datatypes.JSONMap `json:"metadata"`
+	Counts           map[string]int    `json:"counts"`
+	CreatedAt        time.Time         `json:"created_at"`
+	UpdatedAt        time.Time         `json:"updated_at"`
+}
 
-	if result.Error != nil {
-		log.Print(nil).Error("Could not create user", result.Error)
+// UserDataExport reúne todos os dados de um usuário para pedidos de acesso (LGPD/GDPR)
+type UserDataExport struct {
+	User              *UserExport        `json:"user"`
+	CompanyName       string             `json:"company_name"`
+	History           []*UserHistory     `json:"history"`
+	MessageCounters   []MessageCounter   `json:"message_counters"`
+	HourlyCounters    []HourlyCounter    `json:"hourly_counters"`
+	Recipients        []RecipientLog     `json:"recipients"`
+	AllowedRecipients []AllowedRecipient `json:"allowed_recipients"`
+	Deliveries        []WebhookDelivery  `json:"deliveries"`
+	ConnectionEvents  []ConnectionEvent  `json:"connection_events"`
+	Templates         []MessageTemplate  `json:"templates"`
+	ExportedAt        time.Time          `json:"exported_at"`
+}
 
-		return 0, result.Error
-	}
+type TableSize struct {
+	Rows  int64
+	Bytes int64
+}
 
-	return int(user.ID), nil
+type DashboardSummary struct {
+	ConnectedCount   int64            `json:"connected_count"`
+	TotalUsers       int64            `json:"total_users"`
+	TodayByType      map[string]int64 `json:"today_by_type"`
+	ConnectionsLimit int              `json:"connections_limit"`
+	NearLimit        bool             `json:"near_limit"`
 }
 
-func (s *service) UpdateUser(user *User) error {
+type HealthScore struct {
+	Score           int
+	Category        string
+	UptimePercent   float64
+	ConnectAttempts int
+	WebhookFailures int
+}
 
-	result := s.db.Save(user)
+type StatusChange struct {
+	UserID    uint
+	Instance  string
+	EventType string
+	At        time.Time
+}
 
-	if result.Error != nil {
-		log.Print(nil).Error("Could not update user", result.Error)
+type CounterAnomaly struct {
+	UserID     uint
+	MsgType    string
+	Total      int64
+	HistorySum int64
+	Reason     string
+}
 
-		return result.Error
-	}
+type CapViolation struct {
+	CompanyID int
+	Instance  string
+	Count     int64
+	Cap       int
+}
 
-	return nil
+// UserStability resume as quedas de conexão do usuário em um período
+type UserStability struct {
+	UserID     uint
+	Name       string
+	Reconnects int64
+	Downtime   time.Duration
 }
 
-func (s *service) SetQrcode(id int, qrcode string, instance string) error {
-	// log.Info().Msgf("Attempting to set QR code for user %d with instance %s", id, instance)
-	result := s.db.Model(&User{}).Where("id = ?", id).Where("instance = ?", instance).Update("qrcode", qrcode)
-	if result.Error != nil {
-		log.Print(nil).Error("Could not set qrcode for user", result.Error)
-		return result.Error
-	}
+type PlatformSummary struct {
+	TotalCompanies int64 `json:"total_companies"`
+	TotalUsers     int64 `json:"total_users"`
+	ConnectedUsers int64 `json:"connected_users"`
+	MessagesToday  int64 `json:"messages_today"`
+}
 
-	if result.RowsAffected == 0 {
-		log.Print(nil).Warnf("No rows affected when setting QR code for user %d with instance %s", id, instance)
-		return fmt.Errorf("no rows affected")
-	}
+type Projection struct {
+	CurrentCount  int
+	Limit         int
+	GrowthPerDay  float64
+	DaysRemaining float64
+	ExhaustsAt    time.Time
+}
 
-	// log.Info().Msgf("Successfully set QR code for user %d with instance %s", id, instance)
-	return nil
+type InstanceDashboardResult struct {
+	ConnectedCount int64            `json:"connected_count"`
+	PendingQrCount int64            `json:"pending_qr_count"`
+	TodayByType    map[string]int64 `json:"today_by_type"`
 }
 
-func (s *service) SetWebhook(id int, webhook string) error {
+type CompanyRedisStatus struct {
+	CompanyID int
+	Name      string
+	Error     string
+}
 
-	err := s.db.Model(&User{}).Where("id = ?", id).Update("webhook", webhook).Error
+type SpikeAlert struct {
+	UserID     uint
+	TodayTotal int
+	Average    float64
+}
 
-	if err != nil {
-		log.Print(nil).Error("Could not set webhook", err)
+type service struct {
+	db             *gorm.DB
+	hourlyCounters bool
+	// Clientes do Redis de cada empresa, criados sob demanda por companyRedis
+	redisMu      sync.Mutex
+	redisClients map[int]*companyRedisClient
+}
 
-		return err
+func isValidMessageType(typeMsg string) bool {
+	for _, t := range messageTypes {
+		if t == typeMsg {
+			return true
+		}
 	}
 
-	return nil
+	return false
 }
 
-func (s *service) SetConnected(id int) error {
-
-	err := s.db.Model(&User{}).Where("id = ?", id).Update("connected", 1).Error
+// normalizeCounterType aceita tipos novos em MessageCounter (ex.: "reaction") sem mudança
+// de schema, mas rejeita nomes vazios ou malformados que criariam linhas espúrias
+func normalizeCounterType(msgType string) (string, error) {
+	msgType = strings.ToLower(strings.TrimSpace(msgType))
 
-	if err != nil {
-		log.Print(nil).Error("Could not set user as connected", err)
+	if msgType == "" || len(msgType) > 32 {
+		return "", ErrInvalidMessageType
+	}
 
-		return err
+	for i, r := range msgType {
+		switch {
+		case r >= 'a' && r <= 'z':
+		case i > 0 && (r >= '0' && r <= '9' || r == '_'):
+		default:
+			return "", ErrInvalidMessageType
+		}
 	}
 
-	return nil
+	return msgType, nil
 }
 
-func (s *service) SetDisconnected(id int) error {
+// messageTotalExpr retorna a soma SQL de todas as colunas de contador da tabela
+func messageTotalExpr(table string) string {
+	columns := make([]string, len(messageTypes))
+	for i, typeMsg := range messageTypes {
+		columns[i] = fmt.Sprintf("%s.count_%s_msg", table, typeMsg)
+	}
 
-	err := s.db.Model(&User{}).Where("id = ?", id).Update("connected", 0).Error
+	return "(" + strings.Join(columns, " + ") + ")"
+}
 
-	if err != nil {
-		log.Print(nil).Error("Could not set user as disconnected", err)
+// splitList separa uma lista delimitada por vírgulas, ignorando itens vazios
+func splitList(list string) []string {
+	items := make([]string, 0)
 
-		return err
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
 
-	return nil
+	return items
 }
 
-func (s *service) SetJid(id int, jid string) error {
-
-	err := s.db.Model(&User{}).Where("id = ?", id).Update("jid", jid).Error
-
-	if err != nil {
-		log.Print(nil).Error("Could not set jid", err)
+// validateWebhook aceita vazio (sem webhook) ou uma URL http(s) absoluta
+func validateWebhook(webhook string) error {
+	if webhook == "" {
+		return nil
+	}
 
-		return err
+	parsed, err := url.Parse(webhook)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return ErrInvalidWebhook
 	}
 
 	return nil
 }
 
-func (s *service) SetEvents(id int, events string) error {
-
-	err := s.db.Model(&User{}).Where("id = ?", id).Update("events", events).Error
+// validateEvents exige ao menos um evento e que todos estejam em webhookEvents
+func validateEvents(events string) error {
+	subscribed := splitList(events)
+	if len(subscribed) == 0 {
+		return ErrInvalidEvents
+	}
 
-	if err != nil {
-		log.Print(nil).Error("Could not set events", err)
+	for _, event := range subscribed {
+		known := false
+		for _, valid := range webhookEvents {
+			if strings.EqualFold(event, valid) {
+				known = true
+				break
+			}
+		}
 
-		return err
+		if !known {
+			return ErrInvalidEvents
+		}
 	}
 
 	return nil
 }
 
-func (s *service) SetPairingCode(id int, pairingCode string, instance string) error {
-
-	err := s.db.Model(&User{}).Where("id = ?", id).Where("instance = ?", instance).Update("pairing_code", pairingCode).Error
-
-	if err != nil {
-		log.Print(nil).Error("Could not set pairing code", err)
-
-		return err
+// subscribedTo verifica se a lista de eventos do usuário inclui `event`, comparando
+// item a item (evita falsos positivos por substring) e tratando "All" como todos
+func subscribedTo(events string, event string) bool {
+	for _, subscribed := range splitList(events) {
+		if strings.EqualFold(subscribed, "All") || strings.EqualFold(subscribed, event) {
+			return true
+		}
 	}
 
-	return nil
+	return false
 }
 
-// SetCountMsg incrementa o contador de mensagens diárias do usuário
-func (s *service) SetCountMsg(userID uint, typeMsg string) error {
-	// Definir a data atual
-	now := time.Now()
-	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+// validateProxy aceita vazio (sem proxy) ou uma URL absoluta com esquema suportado
+func validateProxy(proxyUrl string) error {
+	if proxyUrl == "" {
+		return nil
+	}
 
-	// Iniciar uma transação
-	tx := s.db.Begin()
-	if tx.Error != nil {
-		log.Print(nil).Error("Could not start transaction", tx.Error)
-		return tx.Error
+	parsed, err := url.Parse(proxyUrl)
+	if err != nil || parsed.Hostname() == "" {
+		return ErrInvalidProxy
 	}
 
-	// Defer para garantir que a transação seja commitada ou rollback
-	defer func() {
-		if r := recover(); r != nil {
-			tx.Rollback()
-		} else if tx.Error != nil {
-			tx.Rollback()
-		} else {
-			tx.Commit()
+	for _, scheme := range proxySchemes {
+		if parsed.Scheme == scheme {
+			return nil
 		}
-	}()
-
-	// Encontrar ou criar o registro para o dia atual
-	var userHistory UserHistory
-	err := tx.Where("user_id = ? AND date = ?", userID, today).FirstOrCreate(&userHistory, UserHistory{
-		UserID:         userID,
-		Date:           today,
-		DisconnectedAt: nil,
-		ConnectedAt:    nil,
-		IsOnline:       false,
-	}).Error
-	if err != nil {
-		fmt.Println("Erro ao buscar ou criar UserHistory:", err)
-		tx.Rollback()
-		return err
 	}
 
-	// Atualizar os campos baseados no tipo de mensagem
-	switch typeMsg {
-	case "disconnected":
-		disconnectedAt := time.Now()
-		err = tx.Model(&userHistory).Updates(map[string]interface{}{
-			"disconnected_at": &disconnectedAt,
-			"is_online":       false,
-		}).Error
-	case "online":
-		connectedAt := time.Now()
-		err = tx.Model(&userHistory).Updates(map[string]interface{}{
-			"connected_at": &connectedAt,
-			"is_online":    true,
-		}).Error
-	default:
-		column := fmt.Sprintf("count_%s_msg", typeMsg)
-		err = tx.Model(&userHistory).Update(column, gorm.Expr(fmt.Sprintf("%s + ?", column), 1)).Error
+	return ErrInvalidProxy
+}
+
+// HasScope verifica se o usuário pode acessar endpoints do escopo informado;
+// sem usuário não há escopo algum
+func HasScope(user *User, scope string) bool {
+	if user == nil {
+		return false
 	}
 
-	if err != nil {
-		fmt.Println("Erro ao atualizar UserHistory:", err)
-		tx.Rollback()
-		return err
+	for _, granted := range splitList(user.Scopes) {
+		if granted == scope || granted == "admin" {
+			return true
+		}
 	}
 
-	return nil
+	return false
 }
 
-func (s *service) CheckAndSetUserOnline() error {
-	var users []User
-	if err := s.db.Where("connected = ?", 1).Find(&users).Error; err != nil {
-		fmt.Println("Erro ao buscar usuários conectados:", err)
-		return err
+// normalizeJid converte o jid para o formato usuario@servidor, sem device/agent.
+// Números sem servidor são tratados como usuários de s.whatsapp.net
+func normalizeJid(jid string) (string, error) {
+	jid = strings.ToLower(strings.TrimSpace(jid))
+
+	user, server := jid, "s.whatsapp.net"
+	if i := strings.Index(jid, "@"); i >= 0 {
+		user, server = jid[:i], jid[i+1:]
 	}
 
-	for _, user := range users {
-		if err := s.SetCountMsg(user.ID, "online"); err != nil {
-			fmt.Printf("Erro ao chamar SetCountMsg para o usuário %d: %v\n", user.ID, err)
-			// Aqui você pode decidir se quer continuar o loop ou parar em caso de erro
-			// return err
+	if server == "s.whatsapp.net" {
+		user = strings.TrimPrefix(user, "+")
+
+		if i := strings.IndexAny(user, ".:"); i >= 0 {
+			user = user[:i]
 		}
 	}
 
-	return nil
+	if user == "" || server == "" {
+		return "", ErrInvalidJid
+	}
+
+	return user + "@" + server, nil
 }
 
-func (s *service) GetUserById(id int) (*User, error) {
-	var user User
+// usersEtag resume o conjunto de usuários pela quantidade, soma dos ids e último updated_at,
+// os mesmos agregados que ConnectedUsersEtag calcula no banco
+func usersEtag(count int64, idSum int64, lastUpdate time.Time) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%d:%d:%d", count, idSum, lastUpdate.UnixNano())))
 
-	err := s.db.Where("id = ?", id).First(&user).Error
+	return hex.EncodeToString(hash[:])
+}
+
+// sumHistoryByType soma cada coluna de contador das linhas de user_histories
+// selecionadas por `query`, retornando o total por tipo de mensagem
+func sumHistoryByType(query *gorm.DB) (map[string]int64, error) {
+	sums := make([]string, len(messageTypes))
+	for i, typeMsg := range messageTypes {
+		sums[i] = fmt.Sprintf("COALESCE(SUM(user_histories.count_%s_msg), 0)", typeMsg)
+	}
+
+	values := make([]int64, len(messageTypes))
+	dest := make([]interface{}, len(messageTypes))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+
+	if err := query.Select(strings.Join(sums, ", ")).Row().Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	totals := make(map[string]int64, len(messageTypes))
+	for i, typeMsg := range messageTypes {
+		totals[typeMsg] = values[i]
+	}
+
+	return totals, nil
+}
+
+// normalizePhone mantém apenas os dígitos e valida o tamanho de um número E.164 (8 a 15 dígitos)
+func normalizePhone(phone string) (string, error) {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, phone)
+
+	if len(digits) < 8 || len(digits) > 15 {
+		return "", ErrInvalidPhone
+	}
+
+	return digits, nil
+}
+
+// phoneFromJid extrai o telefone de um jid já normalizado. Jids que não são de
+// usuário (grupos, broadcast) não têm telefone e retornam vazio
+func phoneFromJid(jid string) (string, error) {
+	user, server, _ := strings.Cut(jid, "@")
+	if server != "s.whatsapp.net" {
+		return "", nil
+	}
+
+	return normalizePhone(user)
+}
+
+// startOfDay retorna a meia-noite do dia de `t`, chave usada em UserHistory.Date
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// migrateMessageCounters copia as colunas fixas de UserHistory para MessageCounter,
+// ignorando linhas que já existam
+func migrateMessageCounters(db *gorm.DB) error {
+	for _, typeMsg := range messageTypes {
+		query := "INSERT INTO message_counters (user_id, date, msg_type, count, updated_at) " +
+			"SELECT user_id, date, ?, count_%[1]s_msg, ? FROM user_histories WHERE count_%[1]s_msg > 0 AND deleted_at IS NULL"
+
+		switch db.Dialector.Name() {
+		case "mysql":
+			query = "INSERT IGNORE" + strings.TrimPrefix(query, "INSERT")
+		default:
+			query += " ON CONFLICT DO NOTHING"
+		}
+
+		if err := db.Exec(fmt.Sprintf(query, typeMsg), typeMsg, time.Now()).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// guardDuplicateCompanyTokens libera o índice único de Company.Token: empresas removidas
+// que repetem o token recebem um sufixo, e tokens repetidos entre empresas ativas
+// interrompem a inicialização, pois precisam ser trocados manualmente
+func guardDuplicateCompanyTokens(db *gorm.DB) error {
+	if !db.Migrator().HasTable(&Company{}) {
+		return nil
+	}
+
+	var tokens []string
+
+	err := db.Unscoped().Model(&Company{}).Group("token").Having("COUNT(*) > 1").Pluck("token", &tokens).Error
+	if err != nil {
+		return err
+	}
+
+	for _, token := range tokens {
+		var companies []Company
+
+		if err := db.Unscoped().Select("id", "deleted_at").Where("token = ?", token).Order("id ASC").Find(&companies).Error; err != nil {
+			return err
+		}
+
+		var active, deleted []int
+		for _, company := range companies {
+			if company.DeletedAt.Valid {
+				deleted = append(deleted, company.ID)
+			} else {
+				active = append(active, company.ID)
+			}
+		}
+
+		if len(active) > 1 {
+			return fmt.Errorf("companies %v share the same token; assign unique tokens before upgrading", active)
+		}
+
+		// Sem empresa ativa, a removida mais recente mantém o token original
+		if len(active) == 0 {
+			deleted = deleted[:len(deleted)-1]
+		}
+
+		for _, id := range deleted {
+			err := db.Unscoped().Model(&Company{}).Where("id = ?", id).
+				UpdateColumn("token", fmt.Sprintf("%s#deleted-%d", token, id)).Error
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// syncConnectionsInUse inicia connections_in_use com os usuários já conectados,
+// para que empresas existentes não passem do limite ao adotar TryAcquireConnection
+func syncConnectionsInUse(db *gorm.DB) error {
+	return db.Exec("UPDATE companies SET connections_in_use = (SELECT COUNT(*) FROM users " +
+		"WHERE users.company_id = companies.id AND users.connected = 1 AND users.deleted_at IS NULL)").Error
+}
+
+// dedupeUserHistories junta as linhas repetidas de (user_id, date), criadas pela corrida do
+// FirstOrCreate em SetCountMsg, para que o índice único possa ser criado. A linha de menor id
+// é mantida com os contadores somados; linhas removidas só entram na soma se não houver ativas
+func dedupeUserHistories(db *gorm.DB) error {
+	if !db.Migrator().HasTable(&UserHistory{}) || db.Migrator().HasIndex(&UserHistory{}, "idx_user_histories_user_date") {
+		return nil
+	}
+
+	var groups []struct {
+		UserID uint
+		Date   time.Time
+	}
+
+	err := db.Unscoped().Model(&UserHistory{}).Select("user_id, date").
+		Group("user_id, date").Having("COUNT(*) > 1").Scan(&groups).Error
+	if err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, group := range groups {
+			var rows []UserHistory
+
+			err := tx.Unscoped().Where("user_id = ? AND date = ?", group.UserID, group.Date).Order("id ASC").Find(&rows).Error
+			if err != nil {
+				return err
+			}
+
+			sources := make([]UserHistory, 0, len(rows))
+			for _, row := range rows {
+				if !row.DeletedAt.Valid {
+					sources = append(sources, row)
+				}
+			}
+
+			kept := rows[0]
+			if len(sources) == 0 {
+				sources = rows
+			} else {
+				kept.DeletedAt = gorm.DeletedAt{}
+			}
+
+			updates := map[string]interface{}{"deleted_at": kept.DeletedAt, "is_online": false, "connected_at": nil, "disconnected_at": nil}
+			counts := make(map[string]int, len(messageTypes))
+
+			for _, source := range sources {
+				for typeMsg, count := range source.Counts() {
+					counts[typeMsg] += count
+				}
+
+				if source.IsOnline {
+					updates["is_online"] = true
+				}
+
+				if source.ConnectedAt != nil {
+					if current, ok := updates["connected_at"].(*time.Time); !ok || source.ConnectedAt.Before(*current) {
+						updates["connected_at"] = source.ConnectedAt
+					}
+				}
+
+				if source.DisconnectedAt != nil {
+					if current, ok := updates["disconnected_at"].(*time.Time); !ok || source.DisconnectedAt.After(*current) {
+						updates["disconnected_at"] = source.DisconnectedAt
+					}
+				}
+			}
+
+			for typeMsg, count := range counts {
+				updates[fmt.Sprintf("count_%s_msg", typeMsg)] = count
+			}
+
+			if err := tx.Unscoped().Model(&UserHistory{}).Where("id = ?", kept.ID).Updates(updates).Error; err != nil {
+				return err
+			}
+
+			ids := make([]uint, 0, len(rows)-1)
+			for _, row := range rows[1:] {
+				ids = append(ids, row.ID)
+			}
+
+			if err := tx.Unscoped().Where("id IN ?", ids).Delete(&UserHistory{}).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// collapseHistoryRows mantém uma linha por (user_id, date), com a última ocorrência vencendo
+// como num upsert sequencial; o Postgres rejeita um mesmo lote que atualiza a linha duas vezes
+func collapseHistoryRows(rows []UserHistory) []UserHistory {
+	type key struct {
+		userID uint
+		date   int64
+	}
+
+	positions := make(map[key]int, len(rows))
+	collapsed := make([]UserHistory, 0, len(rows))
+
+	for _, row := range rows {
+		k := key{row.UserID, row.Date.UnixNano()}
+
+		if i, ok := positions[k]; ok {
+			collapsed[i] = row
+			continue
+		}
+
+		positions[k] = len(collapsed)
+		collapsed = append(collapsed, row)
+	}
+
+	return collapsed
+}
+
+// backfillJidAndPhone normaliza os jids gravados antes de SetJid normalizar (com sufixo
+// de device) e preenche o telefone a partir deles, para GetUserByPhone e IsJidConnected
+func backfillJidAndPhone(db *gorm.DB) error {
+	var users []*User
+
+	return db.Unscoped().Select("id", "jid", "phone").Where("jid <> ''").FindInBatches(&users, 500, func(tx *gorm.DB, batch int) error {
+		for _, user := range users {
+			normalized, err := normalizeJid(user.Jid)
+			if err != nil {
+				continue
+			}
+
+			phone, _ := phoneFromJid(normalized)
+			if normalized == user.Jid && phone == user.Phone {
+				continue
+			}
+
+			err = db.Unscoped().Model(&User{}).Where("id = ?", user.ID).UpdateColumns(map[string]interface{}{
+				"jid":   normalized,
+				"phone": phone,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}).Error
+}
+
+// dropLegacyMessageCounterIndex remove o índice único anterior à coluna direction,
+// que impediria contadores "in" e "out" do mesmo tipo no mesmo dia
+func dropLegacyMessageCounterIndex(db *gorm.DB) error {
+	if !db.Migrator().HasIndex(&MessageCounter{}, "idx_message_counters_user_date_type") {
+		return nil
+	}
+
+	return db.Migrator().DropIndex(&MessageCounter{}, "idx_message_counters_user_date_type")
+}
+
+// incrementTypedCount incrementa o contador de mensagens enviadas ("out")
+func incrementTypedCount(db *gorm.DB, userID uint, date time.Time, msgType string, n int) error {
+	return incrementDirectionalCount(db, userID, date, msgType, "out", n)
+}
+
+func incrementDirectionalCount(db *gorm.DB, userID uint, date time.Time, msgType string, direction string, n int) error {
+	counter := MessageCounter{
+		UserID:    userID,
+		Date:      startOfDay(date),
+		MsgType:   msgType,
+		Direction: direction,
+		Count:     n,
+	}
+
+	return db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "user_id"}, {Name: "date"}, {Name: "msg_type"}, {Name: "direction"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"count":      gorm.Expr("message_counters.count + ?", n),
+			"updated_at": time.Now(),
+		}),
+	}).Create(&counter).Error
+}
+
+// sessionUptime estima quanto tempo a sessão ficou online dentro de [dayStart, dayEnd)
+// a partir de connected_at/disconnected_at do histórico
+func sessionUptime(history *UserHistory, dayStart time.Time, dayEnd time.Time, now time.Time) time.Duration {
+	if history.ConnectedAt == nil {
+		return 0
+	}
+
+	start := *history.ConnectedAt
+	if start.Before(dayStart) {
+		start = dayStart
+	}
+
+	var end time.Time
+
+	switch {
+	case history.IsOnline:
+		end = now
+	case history.DisconnectedAt != nil && history.DisconnectedAt.After(start):
+		end = *history.DisconnectedAt
+	default:
+		return 0
+	}
+
+	if end.After(dayEnd) {
+		end = dayEnd
+	}
+
+	if end.Before(start) {
+		return 0
+	}
+
+	return end.Sub(start)
+}
+
+// decrementHourlyCount desconta n das horas mais recentes do dia com contagem, sem passar de zero
+func decrementHourlyCount(db *gorm.DB, userID uint, day time.Time, msgType string, n int) error {
+	var counters []HourlyCounter
+
+	err := db.Where("user_id = ? AND msg_type = ? AND count > 0 AND hour_bucket >= ? AND hour_bucket < ?",
+		userID, msgType, day, day.AddDate(0, 0, 1)).
+		Order("hour_bucket DESC").
+		Find(&counters).Error
+	if err != nil {
+		return err
+	}
+
+	for _, counter := range counters {
+		if n == 0 {
+			break
+		}
+
+		taken := counter.Count
+		if taken > n {
+			taken = n
+		}
+		n -= taken
+
+		if err := db.Model(&counter).Update("count", counter.Count-taken).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func incrementHourlyCount(db *gorm.DB, userID uint, at time.Time, msgType string, n int) error {
+	counter := HourlyCounter{
+		UserID:     userID,
+		HourBucket: at.Truncate(time.Hour),
+		MsgType:    msgType,
+		Count:      n,
+	}
+
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "hour_bucket"}, {Name: "msg_type"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"count": gorm.Expr("hourly_counters.count + ?", n)}),
+	}).Create(&counter).Error
+}
+
+func startMysql() (*gorm.DB, error) {
+	// log.Print(nil).Info("Starting mysql")
+
+	dbHost := os.Getenv("DB_HOST")
+	dbPort := os.Getenv("DB_PORT")
+	dbUser := os.Getenv("DB_USER")
+	dbPass := os.Getenv("DB_PASSWORD")
+	dbName := os.Getenv("DB_NAME")
+
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=True&loc=Local", dbUser, dbPass, dbHost, dbPort, dbName)
+	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{
+		TranslateError: true,
+	})
+
+	if err != nil {
+		log.Print(nil).Error("Could not open/create " + dsn)
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// startPostgres initializes the database connection if it hasn't been already
+func startPostgres() (*gorm.DB, error) {
+	dbOnce.Do(func() {
+		// log.Print(nil).Info("Starting postgres")
+
+		dbConnStr = os.Getenv("WHATSAPP_DATASTORE_URI")
+		var err error
+		dbInstance, err = gorm.Open(postgres.Open(dbConnStr), &gorm.Config{
+			PrepareStmt:    true, // Prepara as declarações
+			TranslateError: true, // Converte erros do driver (ex: chave duplicada) para os erros do gorm
+		})
+		if err != nil {
+			log.Print(nil).Error("Could not open/create " + dbConnStr)
+			return
+		}
+		// Configurando o pool de conexões
+		sqlDB, err := dbInstance.DB()
+		if err != nil {
+			log.Print(nil).Error("Could not get DB from gorm.DB")
+			return
+		}
+
+		// Definindo configurações de pool de conexão
+		sqlDB.SetMaxIdleConns(15)  // Número máximo de conexões inativas
+		sqlDB.SetMaxOpenConns(300) // Número máximo de conexões abertas
+		sqlDB.SetConnMaxLifetime(time.Duration(30000) * time.Millisecond)
+		sqlDB.SetConnMaxIdleTime(time.Duration(600000) * time.Millisecond)
+
+		log.Print(nil).Info("Connected to database")
+	})
+
+	if dbInstance == nil {
+		return nil, fmt.Errorf("could not establish database connection")
+	}
+
+	return dbInstance, nil
+}
+
+func NewService(driver string) (Service, error) {
+	var err error
+	var db *gorm.DB
+
+	switch driver {
+	case "mysql":
+		db, err = startMysql()
+	case "postgres":
+		db, err = startPostgres()
+	default:
+		return nil, fmt.Errorf("driver not supported")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newService(db)
+}
+
+// newService cria o schema e aplica as migrações pendentes sobre uma conexão já aberta
+func newService(db *gorm.DB) (*service, error) {
+	// Contadores por hora são opcionais para evitar escritas extras em instalações pequenas
+	hourlyCounters, _ := env.GetEnvBool("WHATSAPP_HOURLY_COUNTERS")
+
+	s := &service{db: db, hourlyCounters: hourlyCounters, redisClients: make(map[int]*companyRedisClient)}
+
+	if err := db.AutoMigrate(&SchemaMigration{}); err != nil {
+		log.Print(nil).Error("Could not migrate database", err)
+
+		return nil, err
+	}
+
+	if err := s.RunMigrations(migrationsPhase(true)); err != nil {
+		return nil, err
+	}
+
+	log.Print(nil).Info("Migrating database")
+
+	err := db.AutoMigrate(&Company{}, &User{}, &UserHistory{}, &MessageCounter{}, &SchemaMigration{}, &CompanySeatSnapshot{}, &HourlyCounter{}, &WebhookDelivery{}, &ConnectionEvent{}, &AllowedRecipient{}, &RecipientLog{}, &MessageTemplate{})
+
+	if err != nil {
+		log.Print(nil).Error("Could not migrate database", err)
+
+		return nil, err
+	}
+
+	if err := s.RunMigrations(migrationsPhase(false)); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *service) CreateUser(user *User) (int, error) {
+
+	result := s.db.Create(user)
+
+	if result.Error != nil {
+		log.Print(nil).Error("Could not create user", result.Error)
+
+		return 0, result.Error
+	}
+
+	return int(user.ID), nil
+}
+
+func (s *service) UpdateUser(user *User) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var current []*User
+
+		if err := tx.Select("instance").Where("id = ?", user.ID).Limit(1).Find(&current).Error; err != nil {
+			return err
+		}
+
+		// instance_changed_at acompanha qualquer troca de instância, não só SetInstance
+		if len(current) == 1 && current[0].Instance != user.Instance {
+			changedAt := time.Now()
+			user.InstanceChangedAt = &changedAt
+		}
+
+		return tx.Save(user).Error
+	})
+
+	if err != nil {
+		log.Print(nil).Error("Could not update user", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) SetQrcode(id int, qrcode string, instance string) error {
+	// log.Info().Msgf("Attempting to set QR code for user %d with instance %s", id, instance)
+	result := s.db.Model(&User{}).Where("id = ?", id).Where("instance = ?", instance).Update("qrcode", qrcode)
+	if result.Error != nil {
+		log.Print(nil).Error("Could not set qrcode for user", result.Error)
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		log.Print(nil).Warnf("No rows affected when setting QR code for user %d with instance %s", id, instance)
+		return fmt.Errorf("no rows affected")
+	}
+
+	// log.Info().Msgf("Successfully set QR code for user %d with instance %s", id, instance)
+	return nil
+}
+
+func (s *service) SetWebhook(id int, webhook string) error {
+
+	err := s.db.Model(&User{}).Where("id = ?", id).Update("webhook", webhook).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not set webhook", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) SetConnected(id int) error {
+
+	err := s.db.Model(&User{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"connected":     1,
+		"last_error":    "",
+		"last_error_at": nil,
+	}).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not set user as connected", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func isValidDisconnectReason(reason string) bool {
+	for _, r := range disconnectReasons {
+		if r == reason {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *service) SetDisconnected(id int, reason string) error {
+	if reason == "" {
+		reason = "unknown"
+	}
+
+	if !isValidDisconnectReason(reason) {
+		return ErrInvalidDisconnectReason
+	}
+
+	err := s.db.Model(&User{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"connected":         0,
+		"disconnect_reason": reason,
+	}).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not set user as disconnected", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) SetJid(id int, jid string) error {
+	normalized, err := normalizeJid(jid)
+	if err != nil {
+		return err
+	}
+
+	// Jids cujo usuário não é um telefone válido são gravados mesmo assim, sem telefone
+	phone, _ := phoneFromJid(normalized)
+
+	err = s.db.Model(&User{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"jid":   normalized,
+		"phone": phone,
+	}).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not set jid", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) SetEvents(id int, events string) error {
+
+	err := s.db.Model(&User{}).Where("id = ?", id).Update("events", events).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not set events", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) SetPairingCode(id int, pairingCode string, instance string) error {
+
+	err := s.db.Model(&User{}).Where("id = ?", id).Where("instance = ?", instance).Updates(map[string]interface{}{
+		"pairing_code":         pairingCode,
+		"pairing_generated_at": time.Now(),
+	}).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not set pairing code", err)
+
+		return err
+	}
+
+	return nil
+}
+
+// SetCountMsg incrementa o contador de mensagens diárias do usuário
+func (s *service) SetCountMsg(userID uint, typeMsg string) error {
+	if typeMsg != "online" && typeMsg != "disconnected" {
+		normalized, err := normalizeCounterType(typeMsg)
+		if err != nil {
+			return err
+		}
+
+		typeMsg = normalized
+	}
+
+	// Definir a data atual
+	today := startOfDay(time.Now())
+
+	// Iniciar uma transação
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		log.Print(nil).Error("Could not start transaction", tx.Error)
+		return tx.Error
+	}
+
+	// Defer para garantir que a transação seja commitada ou rollback
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+		} else if tx.Error != nil {
+			tx.Rollback()
+		} else {
+			tx.Commit()
+		}
+	}()
+
+	// Criar o registro do dia se ainda não existir. Duas mensagens abrindo o dia ao mesmo
+	// tempo esbarram no índice único (user_id, date): quem perde não cria nada e relê a
+	// linha do outro, em vez de falhar e perder o incremento como no FirstOrCreate
+	err := tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "date"}},
+		DoNothing: true,
+	}).Create(&UserHistory{UserID: userID, Date: today}).Error
+
+	var userHistory UserHistory
+	if err == nil {
+		err = tx.Where("user_id = ? AND date = ?", userID, today).First(&userHistory).Error
+	}
+	if err != nil {
+		fmt.Println("Erro ao buscar ou criar UserHistory:", err)
+		tx.Rollback()
+		return err
+	}
+
+	// Atualizar os campos baseados no tipo de mensagem
+	switch typeMsg {
+	case "disconnected":
+		disconnectedAt := time.Now()
+		err = tx.Model(&userHistory).Updates(map[string]interface{}{
+			"disconnected_at": &disconnectedAt,
+			"is_online":       false,
+		}).Error
+	case "online":
+		// connected_at só avança numa reconexão; eventos "online" repetidos da mesma
+		// sessão não podem zerar o uptime já acumulado
+		err = tx.Model(&userHistory).Updates(map[string]interface{}{
+			"connected_at": gorm.Expr("CASE WHEN connected_at IS NULL OR disconnected_at > connected_at THEN ? ELSE connected_at END", time.Now()),
+			"is_online":    true,
+		}).Error
+	default:
+		if isValidMessageType(typeMsg) {
+			column := fmt.Sprintf("count_%s_msg", typeMsg)
+			err = tx.Model(&userHistory).Update(column, gorm.Expr(fmt.Sprintf("%s + ?", column), 1)).Error
+
+			// Total acumulado do usuário, lido por ToResponse, ValidateCounters e
+			// DecrementMessageCount; UpdateColumn para não mexer em updated_at a cada mensagem
+			if err == nil {
+				err = tx.Model(&User{}).Where("id = ?", userID).UpdateColumn(column, gorm.Expr(fmt.Sprintf("%s + ?", column), 1)).Error
+			}
+		}
+
+		if err == nil {
+			err = incrementTypedCount(tx, userID, today, typeMsg, 1)
+		}
+
+		if err == nil && s.hourlyCounters {
+			err = incrementHourlyCount(tx, userID, time.Now(), typeMsg, 1)
+		}
+	}
+
+	if err != nil {
+		fmt.Println("Erro ao atualizar UserHistory:", err)
+		tx.Rollback()
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) CheckAndSetUserOnline() error {
+	var users []User
+	if err := s.db.Where("connected = ?", 1).Find(&users).Error; err != nil {
+		fmt.Println("Erro ao buscar usuários conectados:", err)
+		return err
+	}
+
+	for _, user := range users {
+		if err := s.SetCountMsg(user.ID, "online"); err != nil {
+			fmt.Printf("Erro ao chamar SetCountMsg para o usuário %d: %v\n", user.ID, err)
+			// Aqui você pode decidir se quer continuar o loop ou parar em caso de erro
+			// return err
+		}
+	}
+
+	return nil
+}
+
+func (s *service) GetUserById(id int) (*User, error) {
+	var user User
+
+	err := s.db.Where("id = ?", id).First(&user).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not get user", err)
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (s *service) GetUserByToken(token string) (*User, error) {
+	var user User
+
+	err := s.db.Where("token = ?", token).First(&user).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not get user", err)
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (s *service) GetCompanyByToken(token string) (*Company, error) {
+	var company Company
+
+	err := s.db.Where("token = ?", token).First(&company).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not get company", err)
+		return nil, err
+	}
+
+	// A empresa suspensa ainda é retornada para que o chamador possa exibir o motivo
+	if company.Suspended {
+		return &company, ErrCompanySuspended
+	}
+
+	return &company, nil
+}
+
+func (s *service) ListConnectedUsers() ([]*User, error) {
+	var users []*User
+	instance := os.Getenv("INSTANCE")
+
+	if instance == "" {
+		panic("INSTANCE is not set")
+	}
+
+	err := s.db.Where("connected = ? AND instance = ?", 1, instance).Find(&users).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not list users", err)
+
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (s *service) ListAllUsersCompany(companyId int, instance string) ([]*User, error) {
+	var users []*User
+
+	err := s.db.Where("company_id = ?", companyId).Where("instance = ?", instance).Where("deleted_at IS NULL").Order("connected DESC").Order("id ASC").Find(&users).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not list users", err)
+
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (s *service) DeleteUser(id int) error {
+
+	err := s.db.Delete(&User{}, id).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not delete user", err)
+
+		return err
+	}
+
+	return nil
+}
+
+// Conta usuários conectados para uma `instancia` específica
+func (s *service) CountConnectedUsers(instance string) (int, error) {
+	var count int64
+	err := s.db.Table("users").Where("instance = ? AND connected = ? and deleted_at IS NULL", instance, 1).Count(&count).Error
+	return int(count), err
+}
+
+func (s *service) ListUsersChangedSince(instance string, since time.Time) ([]*User, error) {
+	var users []*User
+
+	err := s.db.Where("instance = ? AND updated_at > ?", instance, since).Order("updated_at ASC").Find(&users).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not list changed users", err)
+
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (s *service) DecrementMessageCount(userID uint, typeMsg string, n int) error {
+	if !isValidMessageType(typeMsg) {
+		return ErrInvalidMessageType
+	}
+
+	if n < 0 {
+		return ErrInvalidCount
+	}
+
+	column := fmt.Sprintf("count_%s_msg", typeMsg)
+	decrement := gorm.Expr(fmt.Sprintf("CASE WHEN %[1]s > ? THEN %[1]s - ? ELSE 0 END", column), n, n)
+	today := startOfDay(time.Now())
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&User{}).Where("id = ?", userID).Update(column, decrement).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(&UserHistory{}).Where("user_id = ? AND date = ?", userID, today).Update(column, decrement).Error; err != nil {
+			return err
+		}
+
+		// SetCountMsg também grava em MessageCounter ("out"), que precisa acompanhar a correção
+		err := tx.Model(&MessageCounter{}).
+			Where("user_id = ? AND date = ? AND msg_type = ? AND direction = ?", userID, today, typeMsg, "out").
+			Update("count", gorm.Expr("CASE WHEN message_counters.count > ? THEN message_counters.count - ? ELSE 0 END", n, n)).Error
+		if err != nil {
+			return err
+		}
+
+		return decrementHourlyCount(tx, userID, today, typeMsg, n)
+	})
+
+	if err != nil {
+		log.Print(nil).Error("Could not decrement message count", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) ListUsersByTodayEvent(instance string, eventType string) ([]*User, error) {
+	var column string
+
+	switch eventType {
+	case "connected":
+		column = "connected_at"
+	case "disconnected":
+		column = "disconnected_at"
+	default:
+		return nil, ErrInvalidConnectionEvent
+	}
+
+	var users []*User
+
+	err := s.db.Joins("JOIN user_histories ON user_histories.user_id = users.id AND user_histories.deleted_at IS NULL").
+		Where("users.instance = ? AND user_histories.date = ?", instance, startOfDay(time.Now())).
+		Where(fmt.Sprintf("user_histories.%s IS NOT NULL", column)).
+		Find(&users).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not list users by today event", err)
+
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (s *service) AuthorizeCompany(token string) (*Company, error) {
+	var result struct {
+		Company        `gorm:"embedded"`
+		ConnectedCount int
+	}
+
+	err := s.db.Model(&Company{}).
+		Select("companies.*, (SELECT COUNT(*) FROM users WHERE users.company_id = companies.id AND users.connected = 1 AND users.deleted_at IS NULL) AS connected_count").
+		Where("token = ?", token).
+		Take(&result).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrCompanyNotFound
+	}
+
+	if err != nil {
+		log.Print(nil).Error("Could not authorize company", err)
+		return nil, err
+	}
+
+	company := result.Company
+
+	if company.Suspended {
+		return &company, ErrCompanySuspended
+	}
+
+	if company.DateLimit != nil && company.DateLimit.Before(time.Now()) {
+		return &company, ErrCompanyExpired
+	}
+
+	if result.ConnectedCount > company.ConnectionsLimit {
+		return &company, ErrCompanyOverLimit
+	}
+
+	return &company, nil
+}
+
+func (s *service) IncrementTypedCount(userID uint, date time.Time, msgType string, n int) error {
+	msgType, err := normalizeCounterType(msgType)
+	if err != nil {
+		return err
+	}
+
+	err = incrementTypedCount(s.db, userID, date, msgType, n)
+
+	if err != nil {
+		log.Print(nil).Error("Could not increment typed count", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) GetTypedCountsAsHistory(userID uint, date time.Time) (*UserHistory, error) {
+	var counters []MessageCounter
+
+	day := startOfDay(date)
+
+	// Os campos fixos de UserHistory sempre contaram apenas mensagens enviadas
+	err := s.db.Where("user_id = ? AND date = ? AND direction = ?", userID, day, "out").Find(&counters).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not get typed counts", err)
+
+		return nil, err
+	}
+
+	history := &UserHistory{UserID: userID, Date: day}
+
+	for _, counter := range counters {
+		switch counter.MsgType {
+		case "text":
+			history.CountTextMsg = counter.Count
+		case "image":
+			history.CountImageMsg = counter.Count
+		case "voice":
+			history.CountVoiceMsg = counter.Count
+		case "video":
+			history.CountVideoMsg = counter.Count
+		case "sticker":
+			history.CountStickerMsg = counter.Count
+		case "location":
+			history.CountLocationMsg = counter.Count
+		case "contact":
+			history.CountContactMsg = counter.Count
+		case "document":
+			history.CountDocumentMsg = counter.Count
+		}
+	}
+
+	return history, nil
+}
+
+func (s *service) RecentUserHistory(userID uint, n int) ([]*UserHistory, error) {
+	var histories []*UserHistory
+
+	err := s.db.Where("user_id = ?", userID).Order("date DESC").Limit(n).Find(&histories).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not list user history", err)
+
+		return nil, err
+	}
+
+	return histories, nil
+}
+
+func (s *service) CreateCompany(company *Company) (int, error) {
+
+	result := s.db.Create(company)
+
+	if errors.Is(result.Error, gorm.ErrDuplicatedKey) {
+		return 0, ErrDuplicateToken
+	}
+
+	if result.Error != nil {
+		log.Print(nil).Error("Could not create company", result.Error)
+
+		return 0, result.Error
+	}
+
+	return company.ID, nil
+}
+
+func (s *service) ListUsersByRecentActivity(companyId int, instance string, limit int) ([]*User, error) {
+	var users []*User
+
+	// Ordena pelo dia do histórico, não pelo updated_at, que muda em qualquer ajuste de linha antiga
+	activity := s.db.Model(&UserHistory{}).Select("user_id, MAX(date) AS last_activity").Group("user_id")
+
+	err := s.db.Joins("LEFT JOIN (?) AS activity ON activity.user_id = users.id", activity).
+		Where("users.company_id = ? AND users.instance = ?", companyId, instance).
+		Order("activity.last_activity IS NULL, activity.last_activity DESC").
+		Order("users.id ASC").
+		Limit(limit).
+		Find(&users).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not list users by recent activity", err)
+
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (s *service) CompanyUptimePercent(companyId int, day time.Time) (float64, error) {
+	var userIDs []uint
+
+	err := s.db.Model(&User{}).Where("company_id = ?", companyId).Pluck("id", &userIDs).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not list company users", err)
+
+		return 0, err
+	}
+
+	if len(userIDs) == 0 {
+		return 0, nil
+	}
+
+	dayStart := startOfDay(day)
+	dayEnd := dayStart.AddDate(0, 0, 1)
+
+	var histories []*UserHistory
+
+	err = s.db.Where("user_id IN ? AND date = ?", userIDs, dayStart).Find(&histories).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not list company history", err)
+
+		return 0, err
+	}
+
+	now := time.Now()
+
+	var total float64
+	for _, history := range histories {
+		total += sessionUptime(history, dayStart, dayEnd, now).Hours() / 24 * 100
+	}
+
+	// Usuários sem histórico no dia contam como 0%
+	return total / float64(len(userIDs)), nil
+}
+
+func (s *service) RunMigrations(migrations []Migration) error {
+	var applied []uint
+
+	if err := s.db.Model(&SchemaMigration{}).Pluck("id", &applied).Error; err != nil {
+		log.Print(nil).Error("Could not list applied migrations", err)
+
+		return err
+	}
+
+	done := make(map[uint]bool, len(applied))
+	for _, id := range applied {
+		done[id] = true
+	}
+
+	pending := make([]Migration, 0, len(migrations))
+	for _, migration := range migrations {
+		if !done[migration.ID] {
+			pending = append(pending, migration)
+		}
+	}
+
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].ID < pending[j].ID
+	})
+
+	for _, migration := range pending {
+		log.Print(nil).Infof("Applying migration %d", migration.ID)
+
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			if err := migration.Up(tx); err != nil {
+				return err
+			}
+
+			return tx.Create(&SchemaMigration{ID: migration.ID, AppliedAt: time.Now()}).Error
+		})
+
+		if err != nil {
+			log.Print(nil).Errorf("Could not apply migration %d: %v", migration.ID, err)
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *service) GetUsersByTokens(tokens []string) (map[string]*User, error) {
+	result := make(map[string]*User, len(tokens))
+
+	for start := 0; start < len(tokens); start += batchQuerySize {
+		end := start + batchQuerySize
+		if end > len(tokens) {
+			end = len(tokens)
+		}
+
+		var users []*User
+
+		err := s.db.Where("token IN ?", tokens[start:end]).Find(&users).Error
+
+		if err != nil {
+			log.Print(nil).Error("Could not get users by tokens", err)
+
+			return nil, err
+		}
+
+		for _, user := range users {
+			result[user.Token] = user
+		}
+	}
+
+	return result, nil
+}
+
+func (s *service) DetectCounterSpikes(instance string, lookbackDays int, factor float64) ([]SpikeAlert, error) {
+	var rows []struct {
+		UserID     uint
+		TodayTotal int
+		PastTotal  int
+	}
+
+	// A média divide por lookbackDays
+	if lookbackDays <= 0 {
+		return nil, ErrInvalidLookback
+	}
+
+	// Com factor <= 0 qualquer tráfego hoje viraria alerta
+	if factor <= 0 {
+		return nil, ErrInvalidSpikeFactor
+	}
+
+	today := startOfDay(time.Now())
+	from := today.AddDate(0, 0, -lookbackDays)
+	total := messageTotalExpr("user_histories")
+
+	err := s.db.Model(&UserHistory{}).
+		Select(fmt.Sprintf("user_histories.user_id, "+
+			"SUM(CASE WHEN user_histories.date = ? THEN %[1]s ELSE 0 END) AS today_total, "+
+			"SUM(CASE WHEN user_histories.date < ? THEN %[1]s ELSE 0 END) AS past_total", total), today, today).
+		Joins("JOIN users ON users.id = user_histories.user_id AND users.deleted_at IS NULL").
+		Where("users.instance = ? AND user_histories.date >= ?", instance, from).
+		Group("user_histories.user_id").
+		Scan(&rows).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not detect counter spikes", err)
+
+		return nil, err
+	}
+
+	alerts := make([]SpikeAlert, 0)
+
+	for _, row := range rows {
+		// Dias sem histórico contam como zero na média; sem base de comparação não há pico
+		average := float64(row.PastTotal) / float64(lookbackDays)
+		if average == 0 {
+			continue
+		}
+
+		if float64(row.TodayTotal) > average*factor {
+			alerts = append(alerts, SpikeAlert{UserID: row.UserID, TodayTotal: row.TodayTotal, Average: average})
+		}
+	}
+
+	return alerts, nil
+}
+
+func (s *service) SetScopes(id int, scopes string) error {
+	granted := splitList(strings.ToLower(scopes))
+
+	// Lista vazia deixaria o token sem acesso a nenhum endpoint
+	if len(granted) == 0 {
+		return ErrInvalidScope
+	}
+
+	for _, scope := range granted {
+		valid := false
+		for _, allowed := range apiScopes {
+			if scope == allowed {
+				valid = true
+				break
+			}
+		}
+
+		if !valid {
+			return ErrInvalidScope
+		}
+	}
+
+	err := s.db.Model(&User{}).Where("id = ?", id).Update("scopes", strings.Join(granted, ",")).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not set scopes", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) SetConnectedWithJid(id int, jid string, instance string) error {
+	normalized, err := normalizeJid(jid)
+	if err != nil {
+		return err
+	}
+
+	// Como em SetJid, um usuário que não é telefone válido só fica sem telefone
+	phone, _ := phoneFromJid(normalized)
+
+	result := s.db.Model(&User{}).Where("id = ? AND instance = ?", id, instance).Updates(map[string]interface{}{
+		"connected":        1,
+		"jid":              normalized,
+		"phone":            phone,
+		"qrcode":           "",
+		"pairing_code":     "",
+		"connect_attempts": 0,
+		"last_error":       "",
+		"last_error_at":    nil,
+	})
+
+	if result.Error != nil {
+		log.Print(nil).Error("Could not set user as connected with jid", result.Error)
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		log.Print(nil).Warnf("No rows affected when setting connected jid for user %d with instance %s", id, instance)
+		return fmt.Errorf("no rows affected")
+	}
+
+	return nil
+}
+
+func (s *service) ListCompaniesWithUsage(limit, offset int) ([]CompanyUsage, int64, error) {
+	var total int64
+
+	if err := s.db.Model(&Company{}).Count(&total).Error; err != nil {
+		log.Print(nil).Error("Could not count companies", err)
+
+		return nil, 0, err
+	}
+
+	var rows []struct {
+		Company        `gorm:"embedded"`
+		ConnectedCount int64
+	}
+
+	connected := s.db.Model(&User{}).Select("company_id, COUNT(*) AS connected_count").Where("connected = ?", 1).Group("company_id")
+
+	err := s.db.Model(&Company{}).
+		Select("companies.*, COALESCE(connected.connected_count, 0) AS connected_count").
+		Joins("LEFT JOIN (?) AS connected ON connected.company_id = companies.id", connected).
+		Order("companies.id ASC").
+		Limit(limit).
+		Offset(offset).
+		Scan(&rows).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not list companies with usage", err)
+
+		return nil, 0, err
+	}
+
+	usages := make([]CompanyUsage, len(rows))
+	for i, row := range rows {
+		usages[i] = CompanyUsage{Company: row.Company, ConnectedCount: row.ConnectedCount}
+	}
+
+	return usages, total, nil
+}
+
+func (s *service) ResetWebhookBackoff(id int) error {
+
+	err := s.db.Model(&User{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"webhook_fail_count":     0,
+		"webhook_disabled_until": nil,
+	}).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not reset webhook backoff", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) DeduplicateActiveSessions() ([]int, error) {
+	disconnected := make([]int, 0)
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		duplicated := tx.Model(&User{}).Select("jid").
+			Where("connected = ? AND jid <> ''", 1).
+			Group("jid").
+			Having("COUNT(*) > 1")
+
+		var users []*User
+
+		err := tx.Where("connected = ? AND jid IN (?)", 1, duplicated).
+			Order("jid ASC").
+			Order("updated_at DESC").
+			Order("id DESC").
+			Find(&users).Error
+		if err != nil {
+			return err
+		}
+
+		lastJid := ""
+		for _, user := range users {
+			// O primeiro de cada jid é o atualizado mais recentemente e continua conectado
+			if user.Jid != lastJid {
+				lastJid = user.Jid
+				continue
+			}
+
+			disconnected = append(disconnected, int(user.ID))
+		}
+
+		if len(disconnected) == 0 {
+			return nil
+		}
+
+		return tx.Model(&User{}).Where("id IN ?", disconnected).Update("connected", 0).Error
+	})
+
+	if err != nil {
+		log.Print(nil).Error("Could not deduplicate active sessions", err)
+
+		return nil, err
+	}
+
+	return disconnected, nil
+}
+
+func (s *service) InstanceTypeTotals(instance string, day time.Time) (map[string]int64, error) {
+	totals, err := sumHistoryByType(s.db.Model(&UserHistory{}).
+		Joins("JOIN users ON users.id = user_histories.user_id AND users.deleted_at IS NULL").
+		Where("users.instance = ? AND user_histories.date = ?", instance, startOfDay(day)))
+
+	if err != nil {
+		log.Print(nil).Error("Could not get instance type totals", err)
+
+		return nil, err
+	}
+
+	return totals, nil
+}
+
+func (s *service) ListUsersForRetentionDeletion(inactiveFor time.Duration) ([]*User, error) {
+	var users []*User
+
+	// A atividade vem da data do histórico, não de updated_at: escritas de manutenção
+	// (BulkInsertHistory, MergeCounters, backfills) não podem estender a retenção
+	activity := s.db.Model(&UserHistory{}).Select("user_id, MAX(date) AS last_activity").Group("user_id")
+
+	cutoff := time.Now().Add(-inactiveFor)
+
+	// Um dia de histórico só conta como inativo quando termina antes do corte
+	err := s.db.Joins("JOIN companies ON companies.id = users.company_id AND companies.deleted_at IS NULL").
+		Joins("LEFT JOIN (?) AS activity ON activity.user_id = users.id", activity).
+		Where("companies.retention_deletion = ? AND users.connected = ?", true, 0).
+		Where("(activity.last_activity IS NULL AND users.updated_at < ?) OR activity.last_activity < ?", cutoff, startOfDay(cutoff)).
+		Order("users.id ASC").
+		Find(&users).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not list users for retention deletion", err)
+
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (s *service) TryAcquireConnection(companyId int) (bool, error) {
+	result := s.db.Model(&Company{}).
+		Where("id = ? AND connections_in_use < connections_limit", companyId).
+		Update("connections_in_use", gorm.Expr("connections_in_use + 1"))
+
+	if result.Error != nil {
+		log.Print(nil).Error("Could not acquire company connection", result.Error)
+
+		return false, result.Error
+	}
+
+	return result.RowsAffected == 1, nil
+}
+
+func (s *service) ReleaseConnection(companyId int) error {
+
+	err := s.db.Model(&Company{}).
+		Where("id = ? AND connections_in_use > 0", companyId).
+		Update("connections_in_use", gorm.Expr("connections_in_use - 1")).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not release company connection", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) GetCompanyByUserToken(userToken string) (*Company, error) {
+	var company Company
+
+	err := s.db.Joins("JOIN users ON users.company_id = companies.id AND users.deleted_at IS NULL").
+		Where("users.token = ?", userToken).
+		Take(&company).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrCompanyNotFound
+	}
+
+	if err != nil {
+		log.Print(nil).Error("Could not get company by user token", err)
+		return nil, err
+	}
+
+	return &company, nil
+}
+
+func (s *service) SetUserMetadata(id int, meta map[string]string) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var user User
+
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "metadata").Where("id = ?", id).First(&user).Error
+		if err != nil {
+			return err
+		}
+
+		merged := datatypes.JSONMap{}
+		for key, value := range user.Metadata {
+			merged[key] = value
+		}
+
+		for key, value := range meta {
+			if value == "" {
+				delete(merged, key)
+				continue
+			}
+
+			merged[key] = value
+		}
+
+		return tx.Model(&User{}).Where("id = ?", id).Update("metadata", merged).Error
+	})
+
+	if err != nil {
+		log.Print(nil).Error("Could not set user metadata", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) GetUserMetadata(id int) (map[string]string, error) {
+	var user User
+
+	err := s.db.Select("id", "metadata").Where("id = ?", id).First(&user).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not get user metadata", err)
+		return nil, err
+	}
+
+	meta := make(map[string]string, len(user.Metadata))
+	for key, value := range user.Metadata {
+		if text, ok := value.(string); ok {
+			meta[key] = text
+		} else {
+			meta[key] = fmt.Sprint(value)
+		}
+	}
+
+	return meta, nil
+}
+
+func (s *service) FindUsersByMetadata(companyId int, key, value string) ([]*User, error) {
+	var users []*User
+
+	err := s.db.Where("company_id = ?", companyId).
+		Where(datatypes.JSONQuery("metadata").Equals(value, key)).
+		Find(&users).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not find users by metadata", err)
+
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (s *service) BulkInsertHistory(rows []UserHistory) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	batchSize, err := env.GetEnvInt("WHATSAPP_DATASTORE_BATCH_SIZE")
+	if err != nil || batchSize <= 0 {
+		batchSize = 100
+	}
+
+	columns := []string{"is_online", "connected_at", "disconnected_at", "updated_at"}
+	for _, typeMsg := range messageTypes {
+		columns = append(columns, fmt.Sprintf("count_%s_msg", typeMsg))
+	}
+
+	err = s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "date"}},
+		DoUpdates: clause.AssignmentColumns(columns),
+	}).CreateInBatches(collapseHistoryRows(rows), batchSize).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not bulk insert user history", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) RecordConnectAttempt(id int) error {
+
+	err := s.db.Model(&User{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"connect_attempts":     gorm.Expr("connect_attempts + 1"),
+		"last_connect_attempt": time.Now(),
+	}).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not record connect attempt", err)
+
+		return err
+	}
+
+	return nil
+}
+
+// ConnectionHealth combina três sinais em uma nota de 0 a 100:
+//   - uptime dos últimos 7 dias: até 60 pontos (60 * percentual online)
+//   - tentativas de reconexão pendentes: 20 pontos, menos 4 por tentativa
+//   - falhas de webhook consecutivas: 20 pontos, menos 2 por falha
+//
+// A categoria é "green" a partir de 80, "yellow" a partir de 50 e "red" abaixo disso.
+func (s *service) ConnectionHealth(userID uint) (*HealthScore, error) {
+	var user User
+
+	if err := s.db.Where("id = ?", userID).First(&user).Error; err != nil {
+		log.Print(nil).Error("Could not get user", err)
+		return nil, err
+	}
+
+	now := time.Now()
+	windowStart := startOfDay(now).AddDate(0, 0, -6)
+
+	var histories []*UserHistory
+
+	err := s.db.Where("user_id = ? AND date >= ?", userID, windowStart).Find(&histories).Error
+	if err != nil {
+		log.Print(nil).Error("Could not list user history", err)
+		return nil, err
+	}
+
+	var uptime time.Duration
+	for _, history := range histories {
+		uptime += sessionUptime(history, history.Date, history.Date.AddDate(0, 0, 1), now)
+	}
+
+	uptimePercent := uptime.Hours() / now.Sub(windowStart).Hours() * 100
+	if uptimePercent > 100 {
+		uptimePercent = 100
+	}
+
+	attemptsPenalty := user.ConnectAttempts * 4
+	if attemptsPenalty > 20 {
+		attemptsPenalty = 20
+	}
+
+	webhookPenalty := user.WebhookFailCount * 2
+	if webhookPenalty > 20 {
+		webhookPenalty = 20
+	}
+
+	score := int(uptimePercent*0.6) + (20 - attemptsPenalty) + (20 - webhookPenalty)
+
+	category := "red"
+	switch {
+	case score >= 80:
+		category = "green"
+	case score >= 50:
+		category = "yellow"
+	}
+
+	return &HealthScore{
+		Score:           score,
+		Category:        category,
+		UptimePercent:   uptimePercent,
+		ConnectAttempts: user.ConnectAttempts,
+		WebhookFailures: user.WebhookFailCount,
+	}, nil
+}
+
+func (s *service) ListStalePairings(instance string, olderThan time.Duration) ([]*User, error) {
+	var users []*User
+
+	err := s.db.Where("instance = ? AND connected = ? AND pairing_code <> ''", instance, 0).
+		Where("pairing_generated_at IS NULL OR pairing_generated_at < ?", time.Now().Add(-olderThan)).
+		Find(&users).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not list stale pairings", err)
+
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (s *service) CountUsersByWebhookHost() (map[string]int, error) {
+	var webhooks []string
+
+	err := s.db.Model(&User{}).Where("webhook <> ''").Pluck("webhook", &webhooks).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not list webhooks", err)
+
+		return nil, err
+	}
+
+	counts := make(map[string]int)
+
+	for _, webhook := range webhooks {
+		parsed, err := url.Parse(webhook)
+		if err != nil || parsed.Hostname() == "" {
+			log.Print(nil).Warnf("Skipping unparseable webhook %q", webhook)
+			continue
+		}
+
+		counts[strings.ToLower(parsed.Hostname())]++
+	}
+
+	return counts, nil
+}
+
+func (s *service) CreateUserOnBestInstance(user *User, candidateInstances []string) (int, string, error) {
+	if len(candidateInstances) == 0 {
+		return 0, "", ErrNoInstanceCapacity
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var company Company
+
+		// Travar a empresa serializa criações concorrentes e garante a recontagem abaixo
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", user.CompanyId).First(&company).Error
+		if err != nil {
+			return err
+		}
+
+		var loads []struct {
+			Instance string
+			Total    int
+		}
+
+		err = tx.Model(&User{}).Select("instance, COUNT(*) AS total").
+			Where("company_id = ? AND instance IN ?", user.CompanyId, candidateInstances).
+			Group("instance").
+			Scan(&loads).Error
+		if err != nil {
+			return err
+		}
+
+		load := make(map[string]int, len(loads))
+		for _, l := range loads {
+			load[l.Instance] = l.Total
+		}
+
+		best := ""
+		for _, instance := range candidateInstances {
+			if load[instance] >= company.ConnectionsInstance {
+				continue
+			}
+
+			if best == "" || load[instance] < load[best] {
+				best = instance
+			}
+		}
+
+		if best == "" {
+			return ErrNoInstanceCapacity
+		}
+
+		assignedAt := time.Now()
+		user.Instance = best
+		user.InstanceChangedAt = &assignedAt
+
+		return tx.Create(user).Error
+	})
+
+	if err != nil {
+		log.Print(nil).Error("Could not create user on best instance", err)
+
+		return 0, "", err
+	}
+
+	return int(user.ID), user.Instance, nil
+}
+
+func (s *service) CompletedDayCounts(userID uint, day time.Time) (map[string]int, error) {
+	day = startOfDay(day)
+
+	if !day.Before(startOfDay(time.Now())) {
+		return nil, ErrDayNotCompleted
+	}
+
+	var histories []*UserHistory
+
+	err := s.db.Where("user_id = ? AND date = ?", userID, day).Limit(1).Find(&histories).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not get completed day counts", err)
+
+		return nil, err
+	}
+
+	if len(histories) == 0 {
+		return (&UserHistory{}).Counts(), nil
+	}
+
+	return histories[0].Counts(), nil
+}
+
+func (s *service) SetCompanySuspended(id int, suspended bool) error {
+
+	err := s.db.Model(&Company{}).Where("id = ?", id).Update("suspended", suspended).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not set company suspended", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) CompanyInstanceBreakdown(companyId int) (map[string]int, error) {
+	var rows []struct {
+		Instance string
+		Total    int
+	}
+
+	err := s.db.Model(&User{}).Select("instance, COUNT(*) AS total").
+		Where("company_id = ? AND connected = ?", companyId, 1).
+		Group("instance").
+		Scan(&rows).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not get company instance breakdown", err)
+
+		return nil, err
+	}
+
+	breakdown := make(map[string]int, len(rows))
+	for _, row := range rows {
+		breakdown[row.Instance] = row.Total
+	}
+
+	return breakdown, nil
+}
+
+func (s *service) MergeCounters(keepId uint, fromId uint) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var from User
+
+		if err := tx.Where("id = ?", fromId).First(&from).Error; err != nil {
+			return err
+		}
+
+		fromTotals := from.Counts()
+
+		additions := make(map[string]interface{}, len(messageTypes))
+		zeroes := make(map[string]interface{}, len(messageTypes))
+		for _, typeMsg := range messageTypes {
+			column := fmt.Sprintf("count_%s_msg", typeMsg)
+			additions[column] = gorm.Expr(fmt.Sprintf("%s + ?", column), fromTotals[typeMsg])
+			zeroes[column] = 0
+		}
+
+		if err := tx.Model(&User{}).Where("id = ?", keepId).Updates(additions).Error; err != nil {
+			return err
+		}
+
+		var histories []*UserHistory
+
+		if err := tx.Where("user_id = ?", fromId).Find(&histories).Error; err != nil {
+			return err
+		}
+
+		for _, history := range histories {
+			var keep UserHistory
+
+			err := tx.Where("user_id = ? AND date = ?", keepId, history.Date).
+				FirstOrCreate(&keep, UserHistory{UserID: keepId, Date: history.Date}).Error
+			if err != nil {
+				return err
+			}
+
+			counts := history.Counts()
+			sums := make(map[string]interface{}, len(messageTypes))
+			for _, typeMsg := range messageTypes {
+				column := fmt.Sprintf("count_%s_msg", typeMsg)
+				sums[column] = gorm.Expr(fmt.Sprintf("%s + ?", column), counts[typeMsg])
+			}
+
+			if err := tx.Model(&keep).Updates(sums).Error; err != nil {
+				return err
+			}
+		}
+
+		var counters []MessageCounter
+
+		if err := tx.Where("user_id = ?", fromId).Find(&counters).Error; err != nil {
+			return err
+		}
+
+		for _, counter := range counters {
+			if err := incrementDirectionalCount(tx, keepId, counter.Date, counter.MsgType, counter.Direction, counter.Count); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Model(&MessageCounter{}).Where("user_id = ?", fromId).Update("count", 0).Error; err != nil {
+			return err
+		}
+
+		var hourly []HourlyCounter
+
+		if err := tx.Where("user_id = ?", fromId).Find(&hourly).Error; err != nil {
+			return err
+		}
+
+		for _, counter := range hourly {
+			if err := incrementHourlyCount(tx, keepId, counter.HourBucket, counter.MsgType, counter.Count); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Where("user_id = ?", fromId).Delete(&HourlyCounter{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(&UserHistory{}).Where("user_id = ?", fromId).Updates(zeroes).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&User{}).Where("id = ?", fromId).Updates(zeroes).Error
+	})
+
+	if err != nil {
+		log.Print(nil).Error("Could not merge counters", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) ListConnectedUsersWithVersion(instance string) ([]*User, string, error) {
+	var users []*User
+
+	err := s.db.Where("connected = ? AND instance = ?", 1, instance).Order("id ASC").Find(&users).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not list users", err)
+
+		return nil, "", err
+	}
+
+	var idSum int64
+	var lastUpdate time.Time
+
+	for _, user := range users {
+		idSum += int64(user.ID)
+
+		if user.UpdatedAt.After(lastUpdate) {
+			lastUpdate = user.UpdatedAt
+		}
+	}
+
+	return users, usersEtag(int64(len(users)), idSum, lastUpdate), nil
+}
+
+func (s *service) ConnectedUsersEtag(instance string) (string, error) {
+	var summary struct {
+		Total      int64
+		IdSum      int64
+		LastUpdate sql.NullTime
+	}
+
+	err := s.db.Model(&User{}).
+		Select("COUNT(*) AS total, COALESCE(SUM(id), 0) AS id_sum, MAX(updated_at) AS last_update").
+		Where("connected = ? AND instance = ?", 1, instance).
+		Scan(&summary).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not get connected users etag", err)
+
+		return "", err
+	}
+
+	return usersEtag(summary.Total, summary.IdSum, summary.LastUpdate.Time), nil
+}
+
+func (s *service) FindOrphanedHistory() ([]uint, error) {
+	var ids []uint
+
+	err := s.db.Unscoped().Model(&UserHistory{}).
+		Where("NOT EXISTS (SELECT 1 FROM users WHERE users.id = user_histories.user_id)").
+		Order("id ASC").
+		Pluck("id", &ids).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not find orphaned history", err)
+
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+func (s *service) CleanOrphanedHistory() (int64, error) {
+	result := s.db.Unscoped().
+		Where("NOT EXISTS (SELECT 1 FROM users WHERE users.id = user_histories.user_id)").
+		Delete(&UserHistory{})
+
+	if result.Error != nil {
+		log.Print(nil).Error("Could not clean orphaned history", result.Error)
+
+		return 0, result.Error
+	}
+
+	return result.RowsAffected, nil
+}
+
+func (s *service) CountRecentReconnectFailures(instance string, within time.Duration) (int64, error) {
+	var count int64
+
+	err := s.db.Model(&User{}).
+		Where("instance = ? AND connected = ? AND connect_attempts > 0", instance, 0).
+		Where("last_connect_attempt >= ?", time.Now().Add(-within)).
+		Count(&count).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not count reconnect failures", err)
+
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (s *service) SetDeviceInfo(id int, platform, deviceModel string) error {
+
+	err := s.db.Model(&User{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"platform":     platform,
+		"device_model": deviceModel,
+	}).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not set device info", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) ListCompanyUsersByEvent(companyId int, event string) ([]*User, error) {
+	var candidates []*User
+
+	err := s.db.Where("company_id = ? AND connected = ?", companyId, 1).Find(&candidates).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not list company users by event", err)
+
+		return nil, err
+	}
+
+	users := make([]*User, 0, len(candidates))
+	for _, user := range candidates {
+		if subscribedTo(user.Events, event) {
+			users = append(users, user)
+		}
+	}
+
+	return users, nil
+}
+
+func (s *service) CompanyDashboard(companyId int) (*DashboardSummary, error) {
+	var company Company
+
+	if err := s.db.Where("id = ?", companyId).First(&company).Error; err != nil {
+		log.Print(nil).Error("Could not get company", err)
+		return nil, err
+	}
+
+	cacheKey := fmt.Sprintf("dashboard:company:%d", companyId)
+
+	var cache *redis.Client
+	if company.RedisUri != "" {
+		client, err := s.companyRedis(&company)
+		if err != nil {
+			log.Print(nil).Warnf("Could not connect to company %d redis: %v", companyId, err)
+		} else {
+			cache = client
+
+			ctx, cancel := context.WithTimeout(context.Background(), dashboardRedisTimeout)
+			cached, err := cache.Get(ctx, cacheKey).Bytes()
+			cancel()
+
+			if err == nil {
+				var summary DashboardSummary
+				if err := json.Unmarshal(cached, &summary); err == nil {
+					return &summary, nil
+				}
+			}
+		}
+	}
+
+	summary := &DashboardSummary{ConnectionsLimit: company.ConnectionsLimit}
+
+	err := s.db.Model(&User{}).
+		Select("COUNT(*), COALESCE(SUM(CASE WHEN connected = 1 THEN 1 ELSE 0 END), 0)").
+		Where("company_id = ?", companyId).
+		Row().Scan(&summary.TotalUsers, &summary.ConnectedCount)
+
+	if err != nil {
+		log.Print(nil).Error("Could not count company users", err)
+		return nil, err
+	}
+
+	summary.TodayByType, err = sumHistoryByType(s.db.Model(&UserHistory{}).
+		Joins("JOIN users ON users.id = user_histories.user_id AND users.deleted_at IS NULL").
+		Where("users.company_id = ? AND user_histories.date = ?", companyId, startOfDay(time.Now())))
+
+	if err != nil {
+		log.Print(nil).Error("Could not get company today totals", err)
+		return nil, err
+	}
+
+	// Próximo do limite a partir de 90% das conexões contratadas
+	summary.NearLimit = company.ConnectionsLimit > 0 && summary.ConnectedCount*10 >= int64(company.ConnectionsLimit)*9
+
+	if cache != nil {
+		if data, err := json.Marshal(summary); err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), dashboardRedisTimeout)
+			defer cancel()
+
+			if err := cache.Set(ctx, cacheKey, data, dashboardCacheTTL).Err(); err != nil {
+				log.Print(nil).Warnf("Could not cache company %d dashboard: %v", companyId, err)
+			}
+		}
+	}
+
+	return summary, nil
+}
+
+func (s *service) TableStats() (map[string]TableSize, error) {
+	tables := []string{"users", "companies", "user_histories"}
+	stats := make(map[string]TableSize, len(tables))
+
+	for _, table := range tables {
+		var size TableSize
+		var err error
+
+		switch s.db.Dialector.Name() {
+		case "postgres":
+			// reltuples é uma estimativa mantida pelo ANALYZE, evitando um COUNT(*) em tabelas grandes
+			err = s.db.Raw("SELECT GREATEST(reltuples, 0)::bigint, pg_total_relation_size(oid) FROM pg_class WHERE oid = ?::regclass", table).
+				Row().Scan(&size.Rows, &size.Bytes)
+		case "mysql":
+			err = s.db.Raw("SELECT COALESCE(TABLE_ROWS, 0), COALESCE(DATA_LENGTH + INDEX_LENGTH, 0) FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?", table).
+				Row().Scan(&size.Rows, &size.Bytes)
+		default:
+			err = s.db.Table(table).Count(&size.Rows).Error
+		}
+
+		if err != nil {
+			log.Print(nil).Error("Could not get table stats for "+table, err)
+
+			return nil, err
+		}
+
+		stats[table] = size
+	}
+
+	return stats, nil
+}
+
+func (s *service) SetLastError(id int, reason string) error {
+
+	err := s.db.Model(&User{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"last_error":    reason,
+		"last_error_at": time.Now(),
+	}).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not set last error", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) ListUsersWithErrors(instance string) ([]*User, error) {
+	var users []*User
+
+	err := s.db.Where("instance = ? AND last_error <> ''", instance).Order("last_error_at DESC").Find(&users).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not list users with errors", err)
+
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (s *service) CompanyMonthlyGrowth(companyId int, month time.Time) (*GrowthResult, error) {
+	current := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, month.Location())
+	previous := current.AddDate(0, -1, 0)
+	next := current.AddDate(0, 1, 0)
+	total := messageTotalExpr("user_histories")
+
+	result := &GrowthResult{}
+
+	err := s.db.Model(&UserHistory{}).
+		Select(fmt.Sprintf("COALESCE(SUM(CASE WHEN user_histories.date >= ? THEN %[1]s ELSE 0 END), 0), "+
+			"COALESCE(SUM(CASE WHEN user_histories.date < ? THEN %[1]s ELSE 0 END), 0)", total), current, current).
+		Joins("JOIN users ON users.id = user_histories.user_id AND users.deleted_at IS NULL").
+		Where("users.company_id = ? AND user_histories.date >= ? AND user_histories.date < ?", companyId, previous, next).
+		Row().Scan(&result.CurrentTotal, &result.PreviousTotal)
+
+	if err != nil {
+		log.Print(nil).Error("Could not get company monthly growth", err)
+
+		return nil, err
+	}
+
+	if result.PreviousTotal == 0 {
+		result.IsNew = result.CurrentTotal > 0
+		return result, nil
+	}
+
+	result.PercentChange = float64(result.CurrentTotal-result.PreviousTotal) / float64(result.PreviousTotal) * 100
+
+	return result, nil
+}
+
+func (s *service) GlobalAtCapacity(maxTotal int) (bool, error) {
+	if maxTotal <= 0 {
+		limit, err := env.GetEnvInt("GLOBAL_CONNECTION_LIMIT")
+		if err != nil || limit <= 0 {
+			return false, nil
+		}
+
+		maxTotal = limit
+	}
+
+	var count int64
+
+	err := s.db.Model(&User{}).Where("connected = ?", 1).Count(&count).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not count connected users", err)
+
+		return false, err
+	}
+
+	return count >= int64(maxTotal), nil
+}
+
+func (s *service) ListUsersToRestoreByPriority(instance string) ([]*User, error) {
+	var users []*User
+
+	err := s.db.Joins("LEFT JOIN companies ON companies.id = users.company_id AND companies.deleted_at IS NULL").
+		Where("users.connected = ? AND users.instance = ?", 1, instance).
+		Order("COALESCE(companies.priority, 0) DESC").
+		Order("COALESCE(companies.connections_limit, 0) DESC").
+		Order("users.id ASC").
+		Find(&users).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not list users to restore", err)
+
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (s *service) CompanyDailyBreakdown(companyId int, day time.Time) ([]UserDayCount, error) {
+	columns := []string{"users.id AS user_id", "users.name"}
+	for _, typeMsg := range messageTypes {
+		columns = append(columns, fmt.Sprintf("COALESCE(user_histories.count_%[1]s_msg, 0) AS count_%[1]s_msg", typeMsg))
+	}
+
+	var counts []UserDayCount
+
+	err := s.db.Model(&User{}).
+		Select(strings.Join(columns, ", ")).
+		Joins("LEFT JOIN user_histories ON user_histories.user_id = users.id AND user_histories.date = ? AND user_histories.deleted_at IS NULL", startOfDay(day)).
+		Where("users.company_id = ?", companyId).
+		Order("users.id ASC").
+		Scan(&counts).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not get company daily breakdown", err)
+
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+func (s *service) ConfigureUser(id int, webhook, events string) error {
+	if err := validateWebhook(webhook); err != nil {
+		return err
+	}
+
+	if err := validateEvents(events); err != nil {
+		return err
+	}
+
+	err := s.db.Model(&User{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"webhook": webhook,
+		"events":  events,
+	}).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not configure user", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) IsJidConnected(jid string, instance string) (bool, error) {
+	normalized, err := normalizeJid(jid)
+	if err != nil {
+		return false, err
+	}
+
+	var count int64
+
+	err = s.db.Model(&User{}).
+		Where("jid = ? AND instance = ? AND connected = ?", normalized, instance, 1).
+		Count(&count).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not check jid connection", err)
+
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+func (s *service) SnapshotCompanySeats(day time.Time) error {
+	var snapshots []CompanySeatSnapshot
+
+	// Parte das empresas para que as sem usuários também tenham a linha do dia (0 de 0)
+	err := s.db.Model(&Company{}).
+		Select("companies.id AS company_id, COUNT(users.id) AS total_count, " +
+			"COALESCE(SUM(CASE WHEN users.connected = 1 THEN 1 ELSE 0 END), 0) AS connected_count").
+		Joins("LEFT JOIN users ON users.company_id = companies.id AND users.deleted_at IS NULL").
+		Group("companies.id").
+		Scan(&snapshots).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not count company seats", err)
+
+		return err
+	}
+
+	if len(snapshots) == 0 {
+		return nil
+	}
+
+	date := startOfDay(day)
+	for i := range snapshots {
+		snapshots[i].Date = date
+	}
+
+	err = s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "company_id"}, {Name: "date"}},
+		DoUpdates: clause.AssignmentColumns([]string{"connected_count", "total_count"}),
+	}).Create(&snapshots).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not snapshot company seats", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) GetCompanySeatHistory(companyId int, from, to time.Time) ([]CompanySeatSnapshot, error) {
+	var snapshots []CompanySeatSnapshot
+
+	err := s.db.Where("company_id = ? AND date >= ? AND date <= ?", companyId, startOfDay(from), startOfDay(to)).
+		Order("date ASC").
+		Find(&snapshots).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not get company seat history", err)
+
+		return nil, err
+	}
+
+	return snapshots, nil
+}
+
+func (s *service) GetUserByPhone(phone string, instance string) (*User, error) {
+	normalized, err := normalizePhone(phone)
+	if err != nil {
+		return nil, err
+	}
+
+	var user User
+
+	err = s.db.Where("phone = ? AND instance = ?", normalized, instance).First(&user).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not get user", err)
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (s *service) RecalculateUserTotals(id int) error {
+	totals, err := sumHistoryByType(s.db.Model(&UserHistory{}).Where("user_histories.user_id = ?", id))
+
+	if err != nil {
+		log.Print(nil).Error("Could not sum user history", err)
+
+		return err
+	}
+
+	updates := make(map[string]interface{}, len(totals))
+	for typeMsg, total := range totals {
+		updates[fmt.Sprintf("count_%s_msg", typeMsg)] = total
+	}
+
+	err = s.db.Model(&User{}).Where("id = ?", id).Updates(updates).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not recalculate user totals", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) FirstConnectedAt(userID uint) (*time.Time, error) {
+	var first sql.NullTime
+
+	err := s.db.Model(&UserHistory{}).Select("MIN(connected_at)").Where("user_id = ?", userID).Row().Scan(&first)
+
+	if err != nil {
+		log.Print(nil).Error("Could not get first connection", err)
+
+		return nil, err
+	}
+
+	if !first.Valid {
+		return nil, nil
+	}
+
+	return &first.Time, nil
+}
+
+func (s *service) DisconnectCompanyUsers(companyId int) ([]int, error) {
+	var ids []int
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&User{}).Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("company_id = ? AND connected = ?", companyId, 1).
+			Order("id ASC").
+			Pluck("id", &ids).Error
+		if err != nil {
+			return err
+		}
+
+		if len(ids) == 0 {
+			return nil
+		}
+
+		return tx.Model(&User{}).Where("id IN ?", ids).Update("connected", 0).Error
+	})
+
+	if err != nil {
+		log.Print(nil).Error("Could not disconnect company users", err)
+
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+func (s *service) TokenExists(token string) (bool, error) {
+	var exists bool
+
+	err := s.db.Raw("SELECT EXISTS (SELECT 1 FROM users WHERE token = ? AND deleted_at IS NULL)", token).Row().Scan(&exists)
+
+	if err != nil {
+		log.Print(nil).Error("Could not check token", err)
+
+		return false, err
+	}
+
+	return exists, nil
+}
+
+func (s *service) HourlyBreakdown(userID uint, day time.Time) ([]HourCount, error) {
+	dayStart := startOfDay(day)
+
+	var counters []HourlyCounter
+
+	err := s.db.Where("user_id = ? AND hour_bucket >= ? AND hour_bucket < ?", userID, dayStart, dayStart.AddDate(0, 0, 1)).
+		Find(&counters).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not get hourly breakdown", err)
+
+		return nil, err
+	}
+
+	hours := make([]HourCount, 24)
+	for i := range hours {
+		hours[i] = HourCount{Hour: i, ByType: map[string]int{}}
+	}
+
+	for _, counter := range counters {
+		hour := counter.HourBucket.In(dayStart.Location()).Hour()
+
+		hours[hour].Total += counter.Count
+		hours[hour].ByType[counter.MsgType] += counter.Count
+	}
+
+	return hours, nil
+}
+
+func (s *service) SetInstance(id int, instance string) error {
+
+	// Só atualiza (e marca instance_changed_at) quando a instância realmente muda
+	err := s.db.Model(&User{}).Where("id = ? AND instance <> ?", id, instance).Updates(map[string]interface{}{
+		"instance":            instance,
+		"instance_changed_at": time.Now(),
+	}).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not set instance", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) ListUsersRecentlyRebalanced(within time.Duration) ([]*User, error) {
+	var users []*User
+
+	err := s.db.Where("instance_changed_at >= ?", time.Now().Add(-within)).Order("instance_changed_at DESC").Find(&users).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not list recently rebalanced users", err)
+
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (s *service) RecordWebhookDelivery(userID uint, statusCode int, deliveryErr string) error {
+
+	err := s.db.Create(&WebhookDelivery{UserID: userID, StatusCode: statusCode, Error: deliveryErr}).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not record webhook delivery", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) CompanyWebhookErrorRate(companyId int, from, to time.Time) (float64, error) {
+	var total, failed int64
+
+	err := s.db.Model(&WebhookDelivery{}).
+		Select("COUNT(*), COALESCE(SUM(CASE WHEN webhook_deliveries.status_code < 200 OR webhook_deliveries.status_code >= 300 OR webhook_deliveries.error <> '' THEN 1 ELSE 0 END), 0)").
+		Joins("JOIN users ON users.id = webhook_deliveries.user_id AND users.deleted_at IS NULL").
+		Where("users.company_id = ? AND webhook_deliveries.created_at >= ? AND webhook_deliveries.created_at < ?", companyId, from, to).
+		Row().Scan(&total, &failed)
+
+	if err != nil {
+		log.Print(nil).Error("Could not get company webhook error rate", err)
+
+		return 0, err
+	}
+
+	if total == 0 {
+		return 0, nil
+	}
+
+	return float64(failed) / float64(total), nil
+}
+
+func (s *service) GetRandomConnectedUser(instance string) (*User, error) {
+	random := "RANDOM()"
+	if s.db.Dialector.Name() == "mysql" {
+		random = "RAND()"
+	}
+
+	var users []*User
+
+	err := s.db.Where("connected = ? AND instance = ?", 1, instance).Order(random).Limit(1).Find(&users).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not get random connected user", err)
+		return nil, err
+	}
+
+	if len(users) == 0 {
+		return nil, ErrUserNotFound
+	}
+
+	return users[0], nil
+}
+
+func (s *service) RecordConnectionEvent(userID uint, instance string, eventType string) error {
+	if eventType != "connected" && eventType != "disconnected" {
+		return ErrInvalidConnectionEvent
+	}
+
+	err := s.db.Create(&ConnectionEvent{UserID: userID, Instance: instance, EventType: eventType}).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not record connection event", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) AverageReconnectsPerDay(userID uint, from, to time.Time) (float64, error) {
+	var count int64
+
+	err := s.db.Model(&ConnectionEvent{}).
+		Where("user_id = ? AND event_type = ? AND created_at >= ? AND created_at < ?", userID, "connected", from, to).
+		Count(&count).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not count reconnects", err)
+
+		return 0, err
+	}
+
+	days := math.Ceil(to.Sub(from).Hours() / 24)
+	if count == 0 || days <= 0 {
+		return 0, nil
+	}
+
+	return float64(count) / days, nil
+}
+
+func (s *service) AddAllowedRecipient(userID uint, jid string) error {
+	normalized, err := normalizeJid(jid)
+	if err != nil {
+		return err
+	}
+
+	err = s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&AllowedRecipient{UserID: userID, Jid: normalized}).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not add allowed recipient", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) RemoveAllowedRecipient(userID uint, jid string) error {
+	normalized, err := normalizeJid(jid)
+	if err != nil {
+		return err
+	}
+
+	err = s.db.Where("user_id = ? AND jid = ?", userID, normalized).Delete(&AllowedRecipient{}).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not remove allowed recipient", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) ListAllowedRecipients(userID uint) ([]string, error) {
+	var jids []string
+
+	err := s.db.Model(&AllowedRecipient{}).Where("user_id = ?", userID).Order("jid ASC").Pluck("jid", &jids).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not list allowed recipients", err)
+
+		return nil, err
+	}
+
+	return jids, nil
+}
+
+func (s *service) IsRecipientAllowed(userID uint, jid string) (bool, error) {
+	normalized, err := normalizeJid(jid)
+	if err != nil {
+		return false, err
+	}
+
+	var total, matched int64
+
+	err = s.db.Model(&AllowedRecipient{}).
+		Select("COUNT(*), COALESCE(SUM(CASE WHEN jid = ? THEN 1 ELSE 0 END), 0)", normalized).
+		Where("user_id = ?", userID).
+		Row().Scan(&total, &matched)
+
+	if err != nil {
+		log.Print(nil).Error("Could not check allowed recipient", err)
+
+		return false, err
+	}
+
+	return total == 0 || matched > 0, nil
+}
+
+func (s *service) LogRecipient(userID uint, jid string) error {
+	normalized, err := normalizeJid(jid)
+	if err != nil {
+		return err
+	}
+
+	err = s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "jid"}},
+		DoUpdates: clause.AssignmentColumns([]string{"last_at"}),
+	}).Create(&RecipientLog{UserID: userID, Jid: normalized, LastAt: time.Now()}).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not log recipient", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) CountUniqueRecipients(userID uint, from, to time.Time) (int64, error) {
+	var count int64
+
+	err := s.db.Model(&RecipientLog{}).
+		Where("user_id = ? AND last_at >= ? AND last_at < ?", userID, from, to).
+		Count(&count).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not count unique recipients", err)
+
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (s *service) PurgeRecipientLog(olderThan time.Duration) (int64, error) {
+	result := s.db.Where("last_at < ?", time.Now().Add(-olderThan)).Delete(&RecipientLog{})
+
+	if result.Error != nil {
+		log.Print(nil).Error("Could not purge recipient log", result.Error)
+
+		return 0, result.Error
+	}
+
+	return result.RowsAffected, nil
+}
+
+func (s *service) TryStartSend(id int, max int) (bool, error) {
+	result := s.db.Model(&User{}).
+		Where("id = ? AND in_use_sends < ?", id, max).
+		Update("in_use_sends", gorm.Expr("in_use_sends + 1"))
+
+	if result.Error != nil {
+		log.Print(nil).Error("Could not start send", result.Error)
+
+		return false, result.Error
+	}
+
+	return result.RowsAffected == 1, nil
+}
+
+func (s *service) FinishSend(id int) error {
+
+	err := s.db.Model(&User{}).
+		Where("id = ? AND in_use_sends > 0", id).
+		Update("in_use_sends", gorm.Expr("in_use_sends - 1")).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not finish send", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) ExportUserData(id int) (*UserDataExport, error) {
+	export := &UserDataExport{ExportedAt: time.Now()}
+
+	var user User
+
+	if err := s.db.Where("id = ?", id).First(&user).Error; err != nil {
+		log.Print(nil).Error("Could not get user", err)
+		return nil, err
+	}
+
+	export.User = &UserExport{
+		ID:               user.ID,
+		Name:             user.Name,
+		Label:            user.Label,
+		Jid:              user.Jid,
+		Phone:            user.Phone,
+		Webhook:          user.Webhook,
+		Events:           user.Events,
+		Instance:         user.Instance,
+		Connected:        user.Connected == 1,
+		CompanyId:        user.CompanyId,
+		Platform:         user.Platform,
+		DeviceModel:      user.DeviceModel,
+		Locale:           user.Locale,
+		AutoReplyEnabled: user.AutoReplyEnabled,
+		AutoReplyText:    user.AutoReplyText,
+		Metadata:         user.Metadata,
+		Counts:           user.Counts(),
+		CreatedAt:        user.CreatedAt,
+		UpdatedAt:        user.UpdatedAt,
+	}
+
+	if user.CompanyId != 0 {
+		var names []string
+
+		err := s.db.Model(&Company{}).Where("id = ?", user.CompanyId).Limit(1).Pluck("name", &names).Error
+		if err != nil {
+			log.Print(nil).Error("Could not get company name", err)
+			return nil, err
+		}
+
+		if len(names) > 0 {
+			export.CompanyName = names[0]
+		}
+	}
+
+	queries := []struct {
+		name string
+		dest interface{}
+	}{
+		{"history", &export.History},
+		{"message counters", &export.MessageCounters},
+		{"hourly counters", &export.HourlyCounters},
+		{"recipients", &export.Recipients},
+		{"allowed recipients", &export.AllowedRecipients},
+		{"deliveries", &export.Deliveries},
+		{"connection events", &export.ConnectionEvents},
+		{"templates", &export.Templates},
+	}
+
+	for _, query := range queries {
+		if err := s.db.Where("user_id = ?", id).Order("id ASC").Find(query.dest).Error; err != nil {
+			log.Print(nil).Error("Could not export user "+query.name, err)
+			return nil, err
+		}
+	}
+
+	return export, nil
+}
+
+func (s *service) EraseUserData(id int) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		derived := []interface{}{
+			&UserHistory{},
+			&MessageCounter{},
+			&HourlyCounter{},
+			&RecipientLog{},
+			&AllowedRecipient{},
+			&WebhookDelivery{},
+			&ConnectionEvent{},
+			&MessageTemplate{},
+		}
+
+		for _, model := range derived {
+			if err := tx.Unscoped().Where("user_id = ?", id).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Unscoped().Delete(&User{}, id).Error
+	})
+
+	if err != nil {
+		log.Print(nil).Error("Could not erase user data", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) IncrementDirectionalCount(userID uint, typeMsg string, direction string, n int) error {
+	typeMsg, err := normalizeCounterType(typeMsg)
+	if err != nil {
+		return err
+	}
+
+	if direction != "in" && direction != "out" {
+		return ErrInvalidDirection
+	}
+
+	err = incrementDirectionalCount(s.db, userID, time.Now(), typeMsg, direction, n)
+
+	if err != nil {
+		log.Print(nil).Error("Could not increment directional count", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) DirectionalTotals(userID uint, from, to time.Time) (map[string]int64, error) {
+	var rows []struct {
+		Direction string
+		Total     int64
+	}
+
+	err := s.db.Model(&MessageCounter{}).
+		Select("direction, COALESCE(SUM(count), 0) AS total").
+		Where("user_id = ? AND date >= ? AND date < ?", userID, startOfDay(from), to).
+		Group("direction").
+		Scan(&rows).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not get directional totals", err)
+
+		return nil, err
+	}
+
+	totals := map[string]int64{"in": 0, "out": 0}
+	for _, row := range rows {
+		totals[row.Direction] = row.Total
+	}
+
+	return totals, nil
+}
+
+func (s *service) TopCompaniesByUsage(month time.Time, limit int) ([]CompanyUsage, error) {
+	start := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, month.Location())
+
+	var rows []struct {
+		ID    int
+		Name  string
+		Total int64
+	}
+
+	err := s.db.Model(&UserHistory{}).
+		Select(fmt.Sprintf("companies.id, companies.name, SUM(%s) AS total", messageTotalExpr("user_histories"))).
+		Joins("JOIN users ON users.id = user_histories.user_id AND users.deleted_at IS NULL").
+		Joins("JOIN companies ON companies.id = users.company_id AND companies.deleted_at IS NULL").
+		Where("user_histories.date >= ? AND user_histories.date < ?", start, start.AddDate(0, 1, 0)).
+		Group("companies.id, companies.name").
+		Order("total DESC").
+		Limit(limit).
+		Scan(&rows).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not list top companies by usage", err)
+
+		return nil, err
+	}
+
+	usages := make([]CompanyUsage, len(rows))
+	for i, row := range rows {
+		usages[i] = CompanyUsage{Company: Company{ID: row.ID, Name: row.Name}, MessageTotal: row.Total}
+	}
+
+	return usages, nil
+}
+
+func (s *service) ValidateCounters(instance string) ([]CounterAnomaly, error) {
+	columns := []string{"users.id"}
+	sums := make([]string, 0, len(messageTypes))
+	for _, typeMsg := range messageTypes {
+		columns = append(columns, fmt.Sprintf("users.count_%[1]s_msg, COALESCE(history.sum_%[1]s, 0)", typeMsg))
+		sums = append(sums, fmt.Sprintf("SUM(count_%[1]s_msg) AS sum_%[1]s", typeMsg))
+	}
+
+	history := s.db.Model(&UserHistory{}).Select("user_id, " + strings.Join(sums, ", ")).Group("user_id")
+
+	rows, err := s.db.Model(&User{}).
+		Select(strings.Join(columns, ", ")).
+		Joins("LEFT JOIN (?) AS history ON history.user_id = users.id", history).
+		Where("users.instance = ?", instance).
+		Rows()
+
+	if err != nil {
+		log.Print(nil).Error("Could not validate counters", err)
+
+		return nil, err
+	}
+	defer rows.Close()
+
+	anomalies := make([]CounterAnomaly, 0)
+
+	for rows.Next() {
+		var userID uint
+
+		values := make([]int64, len(messageTypes)*2)
+		dest := []interface{}{&userID}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+
+		if err := rows.Scan(dest...); err != nil {
+			log.Print(nil).Error("Could not scan counters", err)
+
+			return nil, err
+		}
+
+		for i, typeMsg := range messageTypes {
+			total, sum := values[i*2], values[i*2+1]
+
+			tolerance := int64(math.Max(counterToleranceMin, float64(sum)*counterToleranceFraction))
+			diff := total - sum
+			if diff < 0 {
+				diff = -diff
+			}
+
+			switch {
+			case total < 0:
+				anomalies = append(anomalies, CounterAnomaly{UserID: userID, MsgType: typeMsg, Total: total, HistorySum: sum, Reason: "negative total"})
+			case diff > tolerance:
+				anomalies = append(anomalies, CounterAnomaly{UserID: userID, MsgType: typeMsg, Total: total, HistorySum: sum, Reason: "total differs from history"})
+			}
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Print(nil).Error("Could not validate counters", err)
+
+		return nil, err
+	}
+
+	return anomalies, nil
+}
+
+func (s *service) TryAcquireQrLock(id int, instance string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+
+	result := s.db.Model(&User{}).
+		Where("id = ? AND instance = ?", id, instance).
+		Where("qr_lock_until IS NULL OR qr_lock_until < ?", now).
+		Update("qr_lock_until", now.Add(ttl))
+
+	if result.Error != nil {
+		log.Print(nil).Error("Could not acquire qr lock", result.Error)
+
+		return false, result.Error
+	}
+
+	return result.RowsAffected == 1, nil
+}
+
+func (s *service) ReleaseQrLock(id int, instance string) error {
+
+	err := s.db.Model(&User{}).Where("id = ? AND instance = ?", id, instance).Update("qr_lock_until", nil).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not release qr lock", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) ListCompanyUsersWithWebhook(companyId int) ([]*User, error) {
+	var users []*User
+
+	err := s.db.Where("company_id = ? AND webhook <> ''", companyId).Order("id ASC").Find(&users).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not list company users with webhook", err)
+
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (s *service) MedianDailyMessages(userID uint, from, to time.Time) (float64, error) {
+	var rows []struct {
+		Date  time.Time
+		Total int64
+	}
+
+	start := startOfDay(from)
+
+	err := s.db.Model(&UserHistory{}).
+		Select(fmt.Sprintf("date, %s AS total", messageTotalExpr("user_histories"))).
+		Where("user_id = ? AND date >= ? AND date < ?", userID, start, to).
+		Scan(&rows).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not get daily messages", err)
+
+		return 0, err
+	}
+
+	byDay := make(map[string]int64, len(rows))
+	for _, row := range rows {
+		byDay[row.Date.In(start.Location()).Format("2006-01-02")] += row.Total
+	}
+
+	totals := make([]int64, 0)
+	for day := start; day.Before(to); day = day.AddDate(0, 0, 1) {
+		totals = append(totals, byDay[day.Format("2006-01-02")])
+	}
+
+	if len(totals) == 0 {
+		return 0, nil
+	}
+
+	sort.Slice(totals, func(i, j int) bool {
+		return totals[i] < totals[j]
+	})
+
+	middle := len(totals) / 2
+	if len(totals)%2 == 1 {
+		return float64(totals[middle]), nil
+	}
+
+	return float64(totals[middle-1]+totals[middle]) / 2, nil
+}
+
+func (s *service) SetLabel(id int, label string) error {
+
+	err := s.db.Model(&User{}).Where("id = ?", id).Update("label", strings.TrimSpace(label)).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not set label", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) ListRecentStatusChanges(within time.Duration) ([]StatusChange, error) {
+	var events []ConnectionEvent
+
+	err := s.db.Where("created_at >= ?", time.Now().Add(-within)).Order("created_at DESC").Order("id DESC").Find(&events).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not list recent status changes", err)
+
+		return nil, err
+	}
+
+	changes := make([]StatusChange, len(events))
+	for i, event := range events {
+		changes[i] = StatusChange{UserID: event.UserID, Instance: event.Instance, EventType: event.EventType, At: event.CreatedAt}
+	}
+
+	return changes, nil
+}
+
+func (s *service) SetCompanyAllowedMsgTypes(id int, msgTypes string) error {
+
+	allowed := splitList(strings.ToLower(msgTypes))
+
+	// Um tipo digitado errado ("vidoe") não restringiria nada sem avisar
+	for _, typeMsg := range allowed {
+		if !isValidMessageType(typeMsg) {
+			return ErrInvalidMessageType
+		}
+	}
+
+	err := s.db.Model(&Company{}).Where("id = ?", id).Update("allowed_msg_types", strings.Join(allowed, ",")).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not set company allowed message types", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) CompanyAllowsType(companyId int, msgType string) (bool, error) {
+	var company Company
+
+	err := s.db.Select("id", "allowed_msg_types").Where("id = ?", companyId).First(&company).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not get company", err)
+		return false, err
+	}
+
+	allowed := splitList(company.AllowedMsgTypes)
+	if len(allowed) == 0 {
+		return true, nil
+	}
+
+	for _, typeMsg := range allowed {
+		if strings.EqualFold(typeMsg, msgType) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (s *service) CompanyOnlinePercent(companyId int) (float64, error) {
+	var total, connected int64
+
+	err := s.db.Model(&User{}).
+		Select("COUNT(*), COALESCE(SUM(CASE WHEN connected = 1 THEN 1 ELSE 0 END), 0)").
+		Where("company_id = ?", companyId).
+		Row().Scan(&total, &connected)
+
+	if err != nil {
+		log.Print(nil).Error("Could not get company online percent", err)
+
+		return 0, err
+	}
+
+	if total == 0 {
+		return 0, nil
+	}
+
+	return float64(connected) / float64(total) * 100, nil
+}
+
+func (s *service) ListUsersByDisconnectReason(instance, reason string) ([]*User, error) {
+	if !isValidDisconnectReason(reason) {
+		return nil, ErrInvalidDisconnectReason
+	}
+
+	var users []*User
+
+	err := s.db.Where("instance = ? AND connected = ? AND disconnect_reason = ?", instance, 0, reason).Find(&users).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not list users by disconnect reason", err)
+
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (s *service) AdminSearchUsers(query string, limit, offset int) ([]*User, int64, error) {
+	query = strings.TrimSpace(query)
+
+	if len([]rune(query)) < adminSearchMinLength {
+		return nil, 0, ErrSearchQueryTooShort
+	}
+
+	// O ESCAPE explícito vale em todos os bancos: o SQLite não tem caractere de escape padrão
+	escaped := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(query)
+
+	search := s.db.Model(&User{}).
+		Where("token LIKE ? ESCAPE '!' OR LOWER(name) LIKE ? ESCAPE '!'", escaped+"%", "%"+strings.ToLower(escaped)+"%").
+		Session(&gorm.Session{})
+
+	var total int64
+
+	if err := search.Count(&total).Error; err != nil {
+		log.Print(nil).Error("Could not count users", err)
+
+		return nil, 0, err
+	}
+
+	var users []*User
+
+	err := search.Order("id ASC").Limit(limit).Offset(offset).Find(&users).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not search users", err)
+
+		return nil, 0, err
+	}
+
+	return users, total, nil
+}
+
+// ConsumeBudget retorna -1 como saldo quando o orçamento é ilimitado
+func (s *service) ConsumeBudget(id int, n int) (int, bool, error) {
+	if n <= 0 {
+		return 0, false, ErrInvalidBudget
+	}
+
+	var user User
+	var consumed bool
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&User{}).
+			Where("id = ? AND daily_budget > 0 AND budget_remaining >= ?", id, n).
+			Update("budget_remaining", gorm.Expr("budget_remaining - ?", n))
+
+		if result.Error != nil {
+			return result.Error
+		}
+
+		consumed = result.RowsAffected == 1
+
+		return tx.Select("id", "daily_budget", "budget_remaining").First(&user, id).Error
+	})
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, false, ErrUserNotFound
+	}
+
+	if err != nil {
+		log.Print(nil).Error("Could not consume budget", err)
+
+		return 0, false, err
+	}
+
+	if user.DailyBudget == 0 {
+		return -1, true, nil
+	}
+
+	return user.BudgetRemaining, consumed, nil
+}
+
+func (s *service) SetDailyBudget(id int, budget int) error {
+	if budget < 0 {
+		return ErrInvalidBudget
+	}
+
+	err := s.db.Model(&User{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"daily_budget":     budget,
+		"budget_remaining": budget,
+	}).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not set daily budget", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) ResetBudgets(instance string) error {
+
+	err := s.db.Model(&User{}).
+		Where("instance = ? AND daily_budget > 0", instance).
+		Update("budget_remaining", gorm.Expr("daily_budget")).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not reset budgets", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) ListCompaniesOverInstanceCap() ([]CapViolation, error) {
+	var violations []CapViolation
+
+	err := s.db.Table("users").
+		Select("users.company_id, users.instance, COUNT(*) AS count, companies.connections_instance AS cap").
+		Joins("JOIN companies ON companies.id = users.company_id AND companies.deleted_at IS NULL").
+		Where("users.deleted_at IS NULL AND users.connected = ?", 1).
+		Group("users.company_id, users.instance, companies.connections_instance").
+		Having("COUNT(*) > companies.connections_instance").
+		Order("users.company_id ASC").Order("users.instance ASC").
+		Scan(&violations).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not list companies over instance cap", err)
+
+		return nil, err
+	}
+
+	return violations, nil
+}
+
+func (s *service) ListUsersMissingEvent(instance string, event string) ([]*User, error) {
+	var candidates []*User
+
+	err := s.db.Where("instance = ? AND connected = ?", instance, 1).Find(&candidates).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not list users missing event", err)
+
+		return nil, err
+	}
+
+	users := make([]*User, 0, len(candidates))
+	for _, user := range candidates {
+		if !subscribedTo(user.Events, event) {
+			users = append(users, user)
+		}
+	}
+
+	return users, nil
+}
+
+func (s *service) RankUsersByStability(companyId int, from, to time.Time) ([]UserStability, error) {
+	var users []*User
+
+	err := s.db.Select("id", "name").Where("company_id = ?", companyId).Order("id ASC").Find(&users).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not list company users", err)
+
+		return nil, err
+	}
+
+	if len(users) == 0 {
+		return []UserStability{}, nil
+	}
+
+	ids := make([]uint, len(users))
+	stats := make(map[uint]*UserStability, len(users))
+	for i, user := range users {
+		ids[i] = user.ID
+		stats[user.ID] = &UserStability{UserID: user.ID, Name: user.Name}
+	}
+
+	var events []ConnectionEvent
+
+	err = s.db.Where("user_id IN ? AND created_at >= ? AND created_at < ?", ids, from, to).
+		Order("user_id ASC").Order("created_at ASC").Order("id ASC").
+		Find(&events).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not list connection events", err)
+
+		return nil, err
+	}
+
+	// Tempo fora do ar = intervalo entre cada desconexão e a conexão seguinte
+	// (ou o fim do período, se o usuário não voltou)
+	downSince := make(map[uint]time.Time)
+	for _, event := range events {
+		stat := stats[event.UserID]
+
+		switch event.EventType {
+		case "disconnected":
+			if _, down := downSince[event.UserID]; !down {
+				downSince[event.UserID] = event.CreatedAt
+			}
+		case "connected":
+			stat.Reconnects++
+
+			if since, down := downSince[event.UserID]; down {
+				stat.Downtime += event.CreatedAt.Sub(since)
+				delete(downSince, event.UserID)
+			}
+		}
+	}
+
+	for userID, since := range downSince {
+		stats[userID].Downtime += to.Sub(since)
+	}
+
+	ranking := make([]UserStability, 0, len(stats))
+	for _, user := range users {
+		ranking = append(ranking, *stats[user.ID])
+	}
+
+	sort.SliceStable(ranking, func(i, j int) bool {
+		if ranking[i].Reconnects != ranking[j].Reconnects {
+			return ranking[i].Reconnects > ranking[j].Reconnects
+		}
+
+		return ranking[i].Downtime > ranking[j].Downtime
+	})
+
+	return ranking, nil
+}
+
+func (s *service) SetWebhookFormat(id int, format string) error {
+	valid := false
+	for _, f := range webhookFormats {
+		if f == format {
+			valid = true
+			break
+		}
+	}
+
+	if !valid {
+		return ErrInvalidWebhookFormat
+	}
+
+	err := s.db.Model(&User{}).Where("id = ?", id).Update("webhook_format", format).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not set webhook format", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) PlatformStats() (*PlatformSummary, error) {
+	today := startOfDay(time.Now())
+
+	summary := &PlatformSummary{}
+
+	err := s.db.Raw(fmt.Sprintf("SELECT "+
+		"(SELECT COUNT(*) FROM companies WHERE deleted_at IS NULL), "+
+		"(SELECT COUNT(*) FROM users WHERE deleted_at IS NULL), "+
+		"(SELECT COUNT(*) FROM users WHERE deleted_at IS NULL AND connected = ?), "+
+		"(SELECT COALESCE(SUM(%s), 0) FROM user_histories WHERE deleted_at IS NULL AND date >= ? AND date < ?)",
+		messageTotalExpr("user_histories")), 1, today, today.AddDate(0, 0, 1)).
+		Row().Scan(&summary.TotalCompanies, &summary.TotalUsers, &summary.ConnectedUsers, &summary.MessagesToday)
+
+	if err != nil {
+		log.Print(nil).Error("Could not get platform stats", err)
+
+		return nil, err
+	}
+
+	return summary, nil
+}
+
+func (s *service) SetProxy(id int, proxyUrl string) error {
+	proxyUrl = strings.TrimSpace(proxyUrl)
+
+	if err := validateProxy(proxyUrl); err != nil {
+		return err
+	}
+
+	err := s.db.Model(&User{}).Where("id = ?", id).Update("proxy_url", proxyUrl).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not set proxy", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) GetProxy(id int) (string, error) {
+	var user User
+
+	err := s.db.Select("id", "proxy_url").Where("id = ?", id).First(&user).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", ErrUserNotFound
+	}
+
+	if err != nil {
+		log.Print(nil).Error("Could not get proxy", err)
+
+		return "", err
+	}
+
+	return user.ProxyUrl, nil
+}
+
+func (s *service) ListUsersWithProxy(instance string) ([]*User, error) {
+	var users []*User
+
+	err := s.db.Where("instance = ? AND connected = ? AND proxy_url <> ?", instance, 1, "").Find(&users).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not list users with proxy", err)
+
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (s *service) SetCompanyResetHour(id int, hour int) error {
+	if hour < 0 || hour > 23 {
+		return ErrInvalidResetHour
+	}
+
+	err := s.db.Model(&Company{}).Where("id = ?", id).Update("reset_hour_utc", hour).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not set company reset hour", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) ResetDueCompanies(now time.Time) ([]int, error) {
+	var ids []int
+
+	err := s.db.Model(&Company{}).
+		Where("reset_hour_utc = ?", now.UTC().Hour()).
+		Order("id ASC").
+		Pluck("id", &ids).Error
 
 	if err != nil {
-		log.Print(nil).Error("Could not get user", err)
+		log.Print(nil).Error("Could not list companies due for reset", err)
+
 		return nil, err
 	}
 
-	return &user, nil
+	return ids, nil
 }
 
-func (s *service) GetUserByToken(token string) (*User, error) {
-	var user User
+func (s *service) RecordWebhookSuccess(id int) error {
 
-	err := s.db.Where("token = ?", token).First(&user).Error
+	err := s.db.Model(&User{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"last_webhook_success_at": time.Now(),
+		"webhook_fail_count":      0,
+		"webhook_disabled_until":  nil,
+	}).Error
 
 	if err != nil {
-		log.Print(nil).Error("Could not get user", err)
+		log.Print(nil).Error("Could not record webhook success", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) ListCompanyUsersByVolume(companyId int, day time.Time, limit int) ([]*User, error) {
+	var users []*User
+
+	err := s.db.Model(&User{}).
+		Select("users.*").
+		Joins("LEFT JOIN user_histories ON user_histories.user_id = users.id AND user_histories.date = ? AND user_histories.deleted_at IS NULL", startOfDay(day)).
+		Where("users.company_id = ?", companyId).
+		Order(fmt.Sprintf("COALESCE(%s, 0) DESC", messageTotalExpr("user_histories"))).
+		Order("users.id ASC").
+		Limit(limit).
+		Find(&users).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not list company users by volume", err)
+
 		return nil, err
 	}
 
-	return &user, nil
+	return users, nil
 }
 
-func (s *service) GetCompanyByToken(token string) (*Company, error) {
+// ProjectLimitExhaustion usa a regressão linear dos conectados em CompanySeatSnapshot;
+// retorna nil quando não há dados suficientes ou o crescimento não é positivo
+func (s *service) ProjectLimitExhaustion(companyId int, lookbackDays int) (*Projection, error) {
 	var company Company
 
-	err := s.db.Where("token = ?", token).First(&company).Error
+	err := s.db.Select("id", "connections_limit").Where("id = ?", companyId).First(&company).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrCompanyNotFound
+	}
 
 	if err != nil {
 		log.Print(nil).Error("Could not get company", err)
+
 		return nil, err
 	}
 
-	return &company, nil
+	today := startOfDay(time.Now())
+
+	var snapshots []CompanySeatSnapshot
+
+	err = s.db.Where("company_id = ? AND date >= ?", companyId, today.AddDate(0, 0, -lookbackDays)).
+		Order("date ASC").
+		Find(&snapshots).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not list company seat snapshots", err)
+
+		return nil, err
+	}
+
+	if len(snapshots) < 2 {
+		return nil, nil
+	}
+
+	first := snapshots[0].Date
+
+	var sumX, sumY, sumXY, sumXX float64
+	for _, snapshot := range snapshots {
+		x := snapshot.Date.Sub(first).Hours() / 24
+		y := float64(snapshot.ConnectedCount)
+
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+
+	n := float64(len(snapshots))
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return nil, nil
+	}
+
+	slope := (n*sumXY - sumX*sumY) / denominator
+	if slope <= 0 {
+		return nil, nil
+	}
+
+	latest := snapshots[len(snapshots)-1]
+
+	projection := &Projection{
+		CurrentCount: latest.ConnectedCount,
+		Limit:        company.ConnectionsLimit,
+		GrowthPerDay: slope,
+	}
+
+	if remaining := company.ConnectionsLimit - latest.ConnectedCount; remaining > 0 {
+		projection.DaysRemaining = float64(remaining) / slope
+	}
+
+	projection.ExhaustsAt = latest.Date.Add(time.Duration(projection.DaysRemaining * 24 * float64(time.Hour)))
+
+	return projection, nil
 }
 
-func (s *service) ListConnectedUsers() ([]*User, error) {
+func (s *service) ListNeverConnectedUsers(companyId int) ([]*User, error) {
 	var users []*User
-	instance := os.Getenv("INSTANCE")
 
-	if instance == "" {
-		panic("INSTANCE is not set")
+	err := s.db.Where("company_id = ? AND jid = ?", companyId, "").
+		Where("NOT EXISTS (SELECT 1 FROM user_histories WHERE user_histories.user_id = users.id AND user_histories.connected_at IS NOT NULL)").
+		Order("id ASC").
+		Find(&users).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not list never connected users", err)
+
+		return nil, err
 	}
 
-	err := s.db.Where("connected = ? AND instance = ?", 1, instance).Find(&users).Error
+	return users, nil
+}
+
+func (s *service) SetEventsForUsers(ids []int, events string) (int, error) {
+	if err := validateEvents(events); err != nil {
+		return 0, err
+	}
+
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	result := s.db.Model(&User{}).Where("id IN ?", ids).Update("events", events)
+
+	if result.Error != nil {
+		log.Print(nil).Error("Could not set events for users", result.Error)
+
+		return 0, result.Error
+	}
+
+	return int(result.RowsAffected), nil
+}
+
+func (s *service) InstanceHasConnectedUsers(instance string) (bool, error) {
+	var exists bool
+
+	err := s.db.Raw("SELECT EXISTS (SELECT 1 FROM users WHERE instance = ? AND connected = ? AND deleted_at IS NULL)", instance, 1).
+		Row().Scan(&exists)
 
 	if err != nil {
-		log.Print(nil).Error("Could not list users", err)
+		log.Print(nil).Error("Could not check connected users", err)
+
+		return false, err
+	}
+
+	return exists, nil
+}
+
+func (s *service) SetAutoReply(id int, enabled bool, text string) error {
+	text = strings.TrimSpace(text)
+
+	if len([]rune(text)) > autoReplyMaxLength || (enabled && text == "") {
+		return ErrInvalidAutoReply
+	}
+
+	err := s.db.Model(&User{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"auto_reply_enabled": enabled,
+		"auto_reply_text":    text,
+	}).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not set auto reply", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) CountPendingQr(instance string) (int64, error) {
+	var count int64
+
+	err := s.db.Model(&User{}).Where("instance = ? AND connected = ? AND qrcode <> ?", instance, 0, "").Count(&count).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not count pending qr", err)
+
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (s *service) InstanceDashboard(instance string) (*InstanceDashboardResult, error) {
+	result := &InstanceDashboardResult{}
+
+	// Conectados e pendentes de QR na mesma consulta, com as mesmas regras de
+	// CountConnectedUsers e CountPendingQr
+	err := s.db.Model(&User{}).
+		Select("COALESCE(SUM(CASE WHEN connected = ? THEN 1 ELSE 0 END), 0), "+
+			"COALESCE(SUM(CASE WHEN connected = ? AND qrcode <> ? THEN 1 ELSE 0 END), 0)", 1, 0, "").
+		Where("instance = ?", instance).
+		Row().Scan(&result.ConnectedCount, &result.PendingQrCount)
+
+	if err != nil {
+		log.Print(nil).Error("Could not count instance users", err)
 
 		return nil, err
 	}
 
-	return users, nil
+	result.TodayByType, err = s.InstanceTypeTotals(instance, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
 }
 
-func (s *service) ListAllUsersCompany(companyId int, instance string) ([]*User, error) {
-	var users []*User
+func (s *service) ListCompaniesCreatedSince(since time.Time) ([]*Company, error) {
+	var companies []*Company
 
-	err := s.db.Where("company_id = ?", companyId).Where("instance = ?", instance).Where("deleted_at IS NULL").Order("connected DESC").Order("id ASC").Find(&users).Error
+	err := s.db.Where("created_at >= ?", since).Order("created_at DESC").Order("id DESC").Find(&companies).Error
 
 	if err != nil {
-		log.Print(nil).Error("Could not list users", err)
+		log.Print(nil).Error("Could not list companies created since", err)
 
 		return nil, err
 	}
 
-	return users, nil
+	return companies, nil
 }
 
-func (s *service) DeleteUser(id int) error {
+func (s *service) CreateTemplate(userID uint, name, body string) (*MessageTemplate, error) {
+	name = strings.TrimSpace(name)
 
-	err := s.db.Delete(&User{}, id).Error
+	if name == "" || len(name) > 255 || strings.TrimSpace(body) == "" {
+		return nil, ErrInvalidTemplate
+	}
+
+	template := &MessageTemplate{UserID: userID, Name: name, Body: body}
+
+	err := s.db.Create(template).Error
+
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return nil, ErrDuplicateTemplate
+	}
 
 	if err != nil {
-		log.Print(nil).Error("Could not delete user", err)
+		log.Print(nil).Error("Could not create template", err)
+
+		return nil, err
+	}
+
+	return template, nil
+}
+
+func (s *service) ListTemplates(userID uint) ([]MessageTemplate, error) {
+	var templates []MessageTemplate
+
+	err := s.db.Where("user_id = ?", userID).Order("name ASC").Find(&templates).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not list templates", err)
+
+		return nil, err
+	}
+
+	return templates, nil
+}
+
+func (s *service) GetTemplate(userID uint, name string) (*MessageTemplate, error) {
+	var template MessageTemplate
+
+	err := s.db.Where("user_id = ? AND name = ?", userID, strings.TrimSpace(name)).First(&template).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrTemplateNotFound
+	}
+
+	if err != nil {
+		log.Print(nil).Error("Could not get template", err)
+
+		return nil, err
+	}
+
+	return &template, nil
+}
+
+func (s *service) DeleteTemplate(userID uint, name string) error {
+	result := s.db.Where("user_id = ? AND name = ?", userID, strings.TrimSpace(name)).Delete(&MessageTemplate{})
+
+	if result.Error != nil {
+		log.Print(nil).Error("Could not delete template", result.Error)
+
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrTemplateNotFound
+	}
+
+	return nil
+}
+
+// MediaTextRatio retorna +Inf quando há mídia mas nenhum texto, e 0 quando não há mensagens
+func (s *service) MediaTextRatio(userID uint, from, to time.Time) (float64, error) {
+	totals, err := sumHistoryByType(s.db.Model(&UserHistory{}).
+		Where("user_id = ? AND date >= ? AND date < ?", userID, startOfDay(from), to))
+
+	if err != nil {
+		log.Print(nil).Error("Could not get media text ratio", err)
+
+		return 0, err
+	}
+
+	media := totals["image"] + totals["video"] + totals["voice"] + totals["sticker"] + totals["document"]
+
+	if totals["text"] == 0 {
+		if media == 0 {
+			return 0, nil
+		}
+
+		return math.Inf(1), nil
+	}
+
+	return float64(media) / float64(totals["text"]), nil
+}
+
+func (s *service) ClaimAndUpdate(id int, instance string, mutate func(*User)) (*User, error) {
+	if mutate == nil {
+		return nil, ErrNilMutate
+	}
+
+	var user User
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", id).First(&user).Error
+		if err != nil {
+			return err
+		}
+
+		if user.Instance != instance {
+			return ErrInstanceMismatch
+		}
+
+		mutate(&user)
+
+		// O callback não pode trocar a linha salva
+		user.ID = uint(id)
+
+		// Mesma regra do UpdateUser: troca de instância atualiza instance_changed_at
+		if user.Instance != instance {
+			changedAt := time.Now()
+			user.InstanceChangedAt = &changedAt
+		}
+
+		return tx.Omit(clause.Associations).Save(&user).Error
+	})
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrUserNotFound
+	}
+
+	if errors.Is(err, ErrInstanceMismatch) {
+		return nil, err
+	}
+
+	if err != nil {
+		log.Print(nil).Error("Could not claim and update user", err)
+
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// BackfillConnectionTimes usa o início do dia (a própria coluna date) como estimativa
+func (s *service) BackfillConnectionTimes(from, to time.Time) (int64, error) {
+	result := s.db.Model(&UserHistory{}).
+		Where("date >= ? AND date < ? AND is_online = ? AND connected_at IS NULL", from, to, true).
+		Update("connected_at", gorm.Expr("date"))
+
+	if result.Error != nil {
+		log.Print(nil).Error("Could not backfill connection times", result.Error)
+
+		return 0, result.Error
+	}
+
+	return result.RowsAffected, nil
+}
+
+func (s *service) ListCompaniesWithBrokenRedis() ([]CompanyRedisStatus, error) {
+	var companies []Company
+
+	err := s.db.Select("id", "name", "redis_uri").Where("redis_uri <> ?", "").Order("id ASC").Find(&companies).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not list companies with redis", err)
+
+		return nil, err
+	}
+
+	failures := make([]error, len(companies))
+	slots := make(chan struct{}, redisAuditConcurrency)
+
+	var wg sync.WaitGroup
+	for i := range companies {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			client, err := s.companyRedis(&companies[i])
+			if err != nil {
+				failures[i] = err
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), redisAuditTimeout)
+			defer cancel()
+
+			failures[i] = client.Ping(ctx).Err()
+		}(i)
+	}
+	wg.Wait()
+
+	broken := make([]CompanyRedisStatus, 0)
+	for i, company := range companies {
+		if failures[i] != nil {
+			broken = append(broken, CompanyRedisStatus{CompanyID: company.ID, Name: company.Name, Error: failures[i].Error()})
+		}
+	}
+
+	return broken, nil
+}
+
+// SetLocale grava a forma canônica da tag (ex.: "pt-br" vira "pt-BR")
+func (s *service) SetLocale(id int, locale string) error {
+	tag, err := language.Parse(strings.TrimSpace(locale))
+	if err != nil {
+		return ErrInvalidLocale
+	}
+
+	err = s.db.Model(&User{}).Where("id = ?", id).Update("locale", tag.String()).Error
+
+	if err != nil {
+		log.Print(nil).Error("Could not set locale", err)
 
 		return err
 	}
@@ -476,9 +5143,20 @@ func (s *service) DeleteUser(id int) error {
 	return nil
 }
 
-// Conta usuários conectados para uma `instancia` específica
-func (s *service) CountConnectedUsers(instance string) (int, error) {
-	var count int64
-	err := s.db.Table("users").Where("instance = ? AND connected = ? and deleted_at IS NULL", instance, 1).Count(&count).Error
-	return int(count), err
+func (s *service) GetLocale(id int) (string, error) {
+	var user User
+
+	err := s.db.Select("id", "locale").Where("id = ?", id).First(&user).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", ErrUserNotFound
+	}
+
+	if err != nil {
+		log.Print(nil).Error("Could not get locale", err)
+
+		return "", err
+	}
+
+	return user.Locale, nil
 }
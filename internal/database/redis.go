@@ -0,0 +1,44 @@
+package database
+
+import (
+	"github.com/redis/go-redis/v9"
+)
+
+// companyRedisClient guarda o cliente do Redis configurado pela empresa (Company.RedisUri)
+// junto com a URI usada para criá-lo, para recriá-lo quando a empresa trocar de Redis
+type companyRedisClient struct {
+	uri    string
+	client *redis.Client
+}
+
+// companyRedis devolve o cliente da empresa, criado na primeira chamada e reaproveitado
+// depois, com o pool de conexões do próprio go-redis. Os timeouts do cliente são só o
+// limite superior: cada chamada define o seu pelo contexto.
+func (s *service) companyRedis(company *Company) (*redis.Client, error) {
+	s.redisMu.Lock()
+	defer s.redisMu.Unlock()
+
+	cached, ok := s.redisClients[company.ID]
+	if ok && cached.uri == company.RedisUri {
+		return cached.client, nil
+	}
+
+	options, err := redis.ParseURL(company.RedisUri)
+	if err != nil {
+		return nil, err
+	}
+
+	options.DialTimeout = redisAuditTimeout
+	options.ReadTimeout = redisAuditTimeout
+	options.WriteTimeout = redisAuditTimeout
+	options.ContextTimeoutEnabled = true
+
+	if ok {
+		cached.client.Close()
+	}
+
+	client := redis.NewClient(options)
+	s.redisClients[company.ID] = &companyRedisClient{uri: company.RedisUri, client: client}
+
+	return client, nil
+}